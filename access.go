@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// AccessContext contains the data of an authenticated user, which the access rules are evaluated against.
+type AccessContext struct {
+	// id of the provider, which authenticated the user
+	Provider  string
+	Subject   string
+	Groups    []string
+	UserInfo  map[string]any
+	IDToken   map[string]any
+	ExpiresAt int64
+	// the current request, can be nil
+	Request *RequestInfo
+}
+
+// RequestInfo contains the data of the HTTP request, which the access rules are evaluated against.
+type RequestInfo struct {
+	Method string
+	Host   string
+	Path   string
+	// first value of each query parameter
+	Query map[string]string
+	// selected headers with lower case names
+	Headers map[string]string
+	// client IP, resolved with the trusted proxies
+	IP string
+}
+
+// newRequestInfo creates the RequestInfo from the request.
+// Only the given headers are included.
+func newRequestInfo(c echo.Context, headers []string) *RequestInfo {
+	r := c.Request()
+	query := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		if len(values) > 0 {
+			query[name] = values[0]
+		}
+	}
+	selectedHeaders := make(map[string]string)
+	for _, name := range headers {
+		if value := r.Header.Get(name); value != "" {
+			selectedHeaders[strings.ToLower(name)] = value
+		}
+	}
+	return &RequestInfo{
+		Method:  r.Method,
+		Host:    r.Host,
+		Path:    r.URL.Path,
+		Query:   query,
+		Headers: selectedHeaders,
+		IP:      c.RealIP(),
+	}
+}
+
+// expressionVariable returns the request as map for the expressions.
+func (r *RequestInfo) expressionVariable() map[string]any {
+	query := make(map[string]any, len(r.Query))
+	for name, value := range r.Query {
+		query[name] = value
+	}
+	headers := make(map[string]any, len(r.Headers))
+	for name, value := range r.Headers {
+		headers[name] = value
+	}
+	return map[string]any{
+		"method":  r.Method,
+		"host":    r.Host,
+		"path":    r.Path,
+		"query":   query,
+		"headers": headers,
+		"ip":      r.IP,
+	}
+}
+
+// newAccessContext creates the AccessContext from the session of the provider.
+func newAccessContext(providerId string, providerSession ProviderSession) *AccessContext {
+	return &AccessContext{
+		Provider:  providerId,
+		Subject:   providerSession.Subject,
+		Groups:    providerSession.Groups,
+		UserInfo:  providerSession.UserInfo,
+		IDToken:   providerSession.IDTokenClaims,
+		ExpiresAt: providerSession.ExpiresAt,
+	}
+}
+
+// User returns the merged claims of the ID token and the user info.
+// On conflicts, the value of the user info is used.
+func (a *AccessContext) User() map[string]any {
+	user := make(map[string]any, len(a.IDToken)+len(a.UserInfo))
+	for key, value := range a.IDToken {
+		user[key] = value
+	}
+	for key, value := range a.UserInfo {
+		user[key] = value
+	}
+	return user
+}
+
+// expressionVariables returns the variables for the evaluation of an Expression.
+func (a *AccessContext) expressionVariables() map[string]any {
+	groups := make([]any, len(a.Groups))
+	for i, group := range a.Groups {
+		groups[i] = group
+	}
+	idToken := a.IDToken
+	if idToken == nil {
+		idToken = map[string]any{}
+	}
+	request := a.Request
+	if request == nil {
+		request = &RequestInfo{}
+	}
+	return map[string]any{
+		"user":       a.User(),
+		"id_token":   idToken,
+		"groups":     groups,
+		"subject":    a.Subject,
+		"provider":   a.Provider,
+		"expires_at": a.ExpiresAt,
+		"request":    request.expressionVariable(),
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gopkg.in/yaml.v3"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrAccessFileInvalid    = errors.New("invalid access file")
+	ErrAccessFileNoProvider = errors.New("access file requires a page with protection")
+)
+
+// name of the access files in the directories of a page
+const accessFileName = ".access.yaml"
+
+// AccessFile is the content of an access file. It restricts the access to its directory and all sub directories
+// additionally to the protection of the page, so it can never grant more access than the page.
+type AccessFile struct {
+	// require a login, also when the path is public
+	Private    bool     `yaml:"private"`
+	Groups     []string `yaml:"groups"`
+	RequireAll bool     `yaml:"require_all"`
+	DenyGroups []string `yaml:"deny_groups"`
+	Expression string   `yaml:"expression"`
+}
+
+// restricts reports if the file restricts the access.
+func (f *AccessFile) restricts() bool {
+	return f.Private || len(f.Groups) > 0 || len(f.DenyGroups) > 0 || f.Expression != ""
+}
+
+// parseAccessFile parses an access file. Unknown fields are rejected, so a typo can not remove a restriction.
+// There is no field to lift the restrictions of the parent directories.
+func parseAccessFile(content []byte) (*AccessFile, error) {
+	file := &AccessFile{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %w", ErrAccessFileInvalid, err)
+	}
+	return file, nil
+}
+
+// isAccessFilePath checks if the path requests an access file.
+func isAccessFilePath(relativePath string) bool {
+	return strings.EqualFold(path.Base(relativePath), accessFileName)
+}
+
+// accessFileDirs returns the directories of the path relative to the page, which can contain an access file.
+// The last segment is included, because the path can be a directory.
+func accessFileDirs(relativePath string) []string {
+	dirs := []string{"/"}
+	current := ""
+	for _, segment := range strings.Split(strings.Trim(relativePath, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		current += "/" + segment
+		dirs = append(dirs, current)
+	}
+	return dirs
+}
+
+// cachedAccessFile is a parsed access file with the modification time and size of the file.
+type cachedAccessFile struct {
+	modTime time.Time
+	size    int64
+	file    *AccessFile
+	err     error
+}
+
+// cachedAccessProtector is the protector of a directory for the current versions of the access files.
+type cachedAccessProtector struct {
+	version   string
+	protector echo.MiddlewareFunc
+	err       error
+}
+
+// accessFiles applies the access files of a page directory.
+// The files are read on the first request and reloaded, when their modification time or size changes.
+type accessFiles struct {
+	pageId  string
+	dir     string
+	baseUrl string
+	// returns the providers and limits of the protection of a path, no providers when the path is unprotected
+	resolve func(relativePath string) ([]string, ExpressionLimits)
+	// compiles the protection of a directory
+	compile func(protection *StaticPageProtection) (echo.MiddlewareFunc, error)
+
+	mu         sync.Mutex
+	files      map[string]*cachedAccessFile
+	protectors map[string]*cachedAccessProtector
+}
+
+func newAccessFiles(pageId, dir, baseUrl string, resolve func(relativePath string) ([]string, ExpressionLimits),
+	compile func(protection *StaticPageProtection) (echo.MiddlewareFunc, error)) *accessFiles {
+	return &accessFiles{
+		pageId:     pageId,
+		dir:        dir,
+		baseUrl:    baseUrl,
+		resolve:    resolve,
+		compile:    compile,
+		files:      make(map[string]*cachedAccessFile),
+		protectors: make(map[string]*cachedAccessProtector),
+	}
+}
+
+// discover loads all access files of the page directory, so invalid files are logged on start.
+func (a *accessFiles) discover() {
+	err := filepath.WalkDir(a.dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || entry.Name() != accessFileName {
+			return err
+		}
+		relativeDir, err := filepath.Rel(a.dir, filepath.Dir(filePath))
+		if err != nil {
+			return err
+		}
+		dir := path.Clean("/" + filepath.ToSlash(relativeDir))
+		// invalid files are logged by load and protector
+		_, _ = a.protector(dir)
+		return nil
+	})
+	if err != nil {
+		log.WithField("id", a.pageId).WithError(err).Warn("Error discovering access files")
+	}
+}
+
+// load returns the access file of the directory, nil when there is none.
+// The file is only parsed again, when it has changed.
+func (a *accessFiles) load(dir string) (*cachedAccessFile, error) {
+	filePath := filepath.Join(a.dir, filepath.FromSlash(dir), accessFileName)
+	info, err := os.Stat(filePath)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		a.mu.Lock()
+		delete(a.files, dir)
+		a.mu.Unlock()
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	cached, ok := a.files[dir]
+	a.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached, cached.err
+	}
+
+	cached = &cachedAccessFile{modTime: info.ModTime(), size: info.Size()}
+	content, err := os.ReadFile(filePath)
+	if err == nil {
+		cached.file, err = parseAccessFile(content)
+	}
+	cached.err = err
+	a.mu.Lock()
+	a.files[dir] = cached
+	a.mu.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{"id": a.pageId, "dir": dir}).WithError(err).Error("Invalid access file")
+	} else {
+		log.WithFields(log.Fields{"id": a.pageId, "dir": dir}).Info("Access file loaded")
+	}
+	return cached, err
+}
+
+// protector returns the protector for the request path, nil when no access file restricts the path.
+// The files of all parent directories are applied with the providers of the protection of the path,
+// which is the matching rule or the page.
+func (a *accessFiles) protector(relativePath string) (echo.MiddlewareFunc, error) {
+	providers, limits := a.resolve(relativePath)
+	var restrictions []StaticPageProtection
+	var version strings.Builder
+	var leaf string
+	for _, dir := range accessFileDirs(relativePath) {
+		cached, err := a.load(dir)
+		if err != nil {
+			return nil, err
+		}
+		if cached == nil || !cached.file.restricts() {
+			continue
+		}
+		restrictions = append(restrictions, StaticPageProtection{
+			Groups:              cached.file.Groups,
+			RequireAll:          cached.file.RequireAll,
+			DenyGroups:          cached.file.DenyGroups,
+			Expression:          cached.file.Expression,
+			ExpressionTimeout:   limits.Timeout,
+			ExpressionMaxAllocs: limits.MaxAllocs,
+		})
+		fmt.Fprintf(&version, "%s@%d.%d;", dir, cached.modTime.UnixNano(), cached.size)
+		leaf = dir
+	}
+	if len(restrictions) == 0 {
+		return nil, nil
+	}
+	if len(providers) == 0 {
+		log.WithFields(log.Fields{"id": a.pageId, "dir": leaf}).WithError(ErrAccessFileNoProvider).Error("Invalid access file")
+		return nil, ErrAccessFileNoProvider
+	}
+
+	// paths of the same directory can match rules with other providers or limits
+	key := fmt.Sprintf("%s|%s|%d|%d", leaf, strings.Join(providers, ","), limits.Timeout, limits.MaxAllocs)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cached, ok := a.protectors[key]; ok && cached.version == version.String() {
+		return cached.protector, cached.err
+	}
+	// the directory is protected with the providers of the path and must fulfill all access files
+	protector, err := a.compile(&StaticPageProtection{Providers: providers, AllOf: restrictions})
+	if err != nil {
+		log.WithFields(log.Fields{"id": a.pageId, "dir": leaf}).WithError(err).Error("Error compiling access files")
+	}
+	a.protectors[key] = &cachedAccessProtector{version: version.String(), protector: protector, err: err}
+	return protector, err
+}
+
+// restricts checks if an access file restricts the path or, when below is set, any directory below the path.
+func (a *accessFiles) restricts(relativePath string, below bool) (bool, error) {
+	paths := []string{relativePath}
+	if below {
+		root := filepath.Join(a.dir, filepath.FromSlash(relativePath))
+		err := filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() || entry.Name() != accessFileName {
+				return err
+			}
+			relativeDir, err := filepath.Rel(a.dir, filepath.Dir(filePath))
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path.Clean("/"+filepath.ToSlash(relativeDir)))
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+
+	for _, restrictedPath := range paths {
+		protector, err := a.protector(restrictedPath)
+		if err != nil || protector != nil {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// hide answers requests for the access files with 404 Not Found.
+func (a *accessFiles) hide(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if isAccessFilePath(relativePagePath(a.baseUrl, c.Request().URL.Path)) {
+			return echo.ErrNotFound
+		}
+		return next(c)
+	}
+}
+
+// middleware applies the access files after the protection of the page.
+// Requests are denied, when an access file is invalid, so a broken file never opens a directory.
+func (a *accessFiles) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		protector, err := a.protector(relativePagePath(a.baseUrl, c.Request().URL.Path))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "The access file of this directory is invalid.")
+		}
+		if protector == nil {
+			return next(c)
+		}
+		return protector(next)(c)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/labstack/echo/v4"
+)
+
+func TestParseAccessFile(t *testing.T) {
+	file, err := parseAccessFile([]byte("groups:\n  - finance\nexpression: 'user.level >= 3'\n"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, file.Groups, []string{"finance"})
+	assert.Equal(t, file.restricts(), true)
+
+	file, err = parseAccessFile([]byte("private: true\n"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, file.restricts(), true)
+
+	file, err = parseAccessFile([]byte(""))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, file.restricts(), false)
+
+	// unknown fields are rejected, a sub directory can not lift the restrictions of its parents
+	_, err = parseAccessFile([]byte("group: finance\n"))
+	assert.Equal(t, errors.Is(err, ErrAccessFileInvalid), true)
+	_, err = parseAccessFile([]byte("public: true\n"))
+	assert.Equal(t, errors.Is(err, ErrAccessFileInvalid), true)
+}
+
+func TestAccessFileDirs(t *testing.T) {
+	assert.Equal(t, accessFileDirs("/"), []string{"/"})
+	assert.Equal(t, accessFileDirs("/file.txt"), []string{"/", "/file.txt"})
+	assert.Equal(t, accessFileDirs("/reports/2024/"), []string{"/", "/reports", "/reports/2024"})
+
+	assert.Equal(t, isAccessFilePath("/reports/.access.yaml"), true)
+	assert.Equal(t, isAccessFilePath("/reports/.ACCESS.yaml"), true)
+	assert.Equal(t, isAccessFilePath("/reports/access.yaml"), false)
+}
+
+func TestAccessFilesProtector(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("reports/.access.yaml", "groups:\n  - finance\n")
+	writeFile("reports/2024/.access.yaml", "expression: 'user.level >= 3'\n")
+	writeFile("reports/2024/q3.pdf", "")
+	writeFile("reports/assets/.access.yaml", "")
+	writeFile("reports/empty/.access.yaml", "")
+
+	var compiled []*StaticPageProtection
+	compile := func(protection *StaticPageProtection) (echo.MiddlewareFunc, error) {
+		compiled = append(compiled, protection)
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }, nil
+	}
+	// the partner directory is protected by a rule with another provider
+	resolve := func(relativePath string) ([]string, ExpressionLimits) {
+		if strings.HasPrefix(relativePath, "/reports/partner") {
+			return []string{"partner"}, ExpressionLimits{}
+		}
+		return []string{"idp"}, ExpressionLimits{}
+	}
+	files := newAccessFiles("reports", dir, "/reports", resolve, compile)
+
+	protector, err := files.protector("/file.txt")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, protector == nil, true)
+
+	// all files of the parent directories are applied with the providers of the page
+	protector, err = files.protector("/reports/2024/q3.pdf")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, protector != nil, true)
+	assert.Equal(t, len(compiled), 1)
+	assert.Equal(t, compiled[0].Providers, []string{"idp"})
+	assert.Equal(t, len(compiled[0].AllOf), 2)
+	assert.Equal(t, compiled[0].AllOf[0].Groups, []string{"finance"})
+	assert.Equal(t, compiled[0].AllOf[1].Expression, "user.level >= 3")
+
+	// the protector is cached until a file changes
+	_, _ = files.protector("/reports/2024/")
+	assert.Equal(t, len(compiled), 1)
+	_, _ = files.protector("/reports/empty/file.txt")
+	assert.Equal(t, len(compiled), 2)
+	assert.Equal(t, len(compiled[1].AllOf), 1)
+	// a file without restrictions keeps the restrictions of the parents
+	protector, err = files.protector("/reports/assets/logo.png")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, protector != nil, true)
+	assert.Equal(t, len(compiled), 2)
+	assert.Equal(t, compiled[1].AllOf[0].Groups, []string{"finance"})
+	writeFile("reports/2024/.access.yaml", "expression: 'user.level >= 10'\n")
+	_, _ = files.protector("/reports/2024/q3.pdf")
+	assert.Equal(t, len(compiled), 3)
+	assert.Equal(t, compiled[2].AllOf[1].Expression, "user.level >= 10")
+
+	// share links check the path or the whole tree below the path
+	restricted, err := files.restricts("/reports/2024/q3.pdf", false)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, restricted, true)
+	restricted, err = files.restricts("/file.txt", false)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, restricted, false)
+	restricted, err = files.restricts("/", true)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, restricted, true)
+	restricted, err = files.restricts("/missing", true)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, restricted, false)
+
+	// the providers of the rule matching the path are used, also for the parent files
+	writeFile("reports/partner/.access.yaml", "groups:\n  - partners\n")
+	_, err = files.protector("/reports/partner/offer.pdf")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(compiled), 4)
+	assert.Equal(t, compiled[3].Providers, []string{"partner"})
+	assert.Equal(t, len(compiled[3].AllOf), 2)
+
+	// restrictions require a protected path
+	unprotected := newAccessFiles("reports", dir, "/reports", func(relativePath string) ([]string, ExpressionLimits) {
+		if strings.HasPrefix(relativePath, "/reports/partner") {
+			return []string{"partner"}, ExpressionLimits{}
+		}
+		return nil, ExpressionLimits{}
+	}, compile)
+	_, err = unprotected.protector("/reports/file.txt")
+	assert.Equal(t, errors.Is(err, ErrAccessFileNoProvider), true)
+	_, err = unprotected.protector("/file.txt")
+	assert.Equal(t, err, nil)
+	_, err = unprotected.protector("/reports/partner/offer.pdf")
+	assert.Equal(t, err, nil)
+}
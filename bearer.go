@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+var (
+	ErrBearerTokenInvalid          = errors.New("bearer token is invalid")
+	ErrBearerTokenInactive         = errors.New("bearer token is not active")
+	ErrBearerIntrospectionEndpoint = errors.New("no introspection endpoint for bearer tokens")
+	ErrBearerIntrospection         = errors.New("bearer token introspection failed")
+)
+
+const (
+	BearerVerificationJWT           = "jwt"
+	BearerVerificationIntrospection = "introspection"
+)
+
+// timeout of a token introspection request
+const introspectionTimeout = 10 * time.Second
+
+// bearerVerifier verifies the access tokens of API and CLI clients.
+// JWT access tokens are verified with the keys of the IdP, opaque tokens with the token introspection (RFC 7662).
+type bearerVerifier struct {
+	// verifies JWT access tokens, nil when the introspection is used
+	verifier *oidc.IDTokenVerifier
+	issuer   string
+	audience string
+	// token introspection
+	introspectionEndpoint string
+	clientID              string
+	clientSecret          string
+	client                *http.Client
+}
+
+// newBearerVerifier creates the verifier for the bearer tokens of the provider.
+func newBearerVerifier(p *Provider) (*bearerVerifier, error) {
+	cfg := p.cfg.BearerTokens
+	v := &bearerVerifier{
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+	}
+
+	if cfg.Verification == BearerVerificationIntrospection {
+		v.introspectionEndpoint = cfg.IntrospectionEndpoint
+		if v.introspectionEndpoint == "" {
+			v.introspectionEndpoint = p.cfg.IntrospectionEndpoint
+		}
+		if v.introspectionEndpoint == "" {
+			return nil, ErrBearerIntrospectionEndpoint
+		}
+		// without issuer, only the tokens of the IdP are accepted
+		if v.issuer == "" {
+			v.issuer = p.cfg.IssuerUrl
+		}
+		v.clientID = p.oauth2Config.ClientID
+		v.clientSecret = p.oauth2Config.ClientSecret
+		v.client = &http.Client{Timeout: introspectionTimeout}
+		return v, nil
+	}
+
+	// without audience, only the tokens issued for this client are accepted,
+	// so tokens of other clients and APIs of the IdP are rejected
+	if v.audience == "" {
+		v.audience = p.oauth2Config.ClientID
+	}
+	// the issuer is checked by the verifier, when no other issuer is configured
+	v.verifier = p.provider.Verifier(&oidc.Config{
+		ClientID:        v.audience,
+		SkipIssuerCheck: cfg.Issuer != "",
+	})
+	return v, nil
+}
+
+// verify verifies the token and returns its claims.
+func (v *bearerVerifier) verify(ctx context.Context, token string) (map[string]any, error) {
+	if v.verifier == nil {
+		return v.introspect(ctx, token)
+	}
+
+	accessToken, err := v.verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBearerTokenInvalid, err)
+	}
+	if v.issuer != "" && accessToken.Issuer != v.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %s", ErrBearerTokenInvalid, accessToken.Issuer)
+	}
+	var claims map[string]any
+	if err := accessToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBearerTokenInvalid, err)
+	}
+	// the ID token of a login has the client id as audience, but it is no credential for the API
+	if isIDToken(claims) {
+		return nil, fmt.Errorf("%w: ID tokens are not accepted", ErrBearerTokenInvalid)
+	}
+	return claims, nil
+}
+
+// isIDToken checks for the claims, which are only set in ID tokens.
+// The login always sends a nonce, so its ID tokens are always recognized.
+func isIDToken(claims map[string]any) bool {
+	_, hasNonce := claims["nonce"]
+	_, hasAtHash := claims["at_hash"]
+	return hasNonce || hasAtHash
+}
+
+// introspect asks the introspection endpoint of the IdP about the token and returns its claims.
+// The client authenticates with the client id and secret of the provider.
+func (v *bearerVerifier) introspect(ctx context.Context, token string) (map[string]any, error) {
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.introspectionEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(v.clientID), url.QueryEscape(v.clientSecret))
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBearerIntrospection, err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrBearerIntrospection, res.StatusCode)
+	}
+
+	var claims map[string]any
+	if err := json.NewDecoder(res.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBearerIntrospection, err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, ErrBearerTokenInactive
+	}
+	if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(time.Now()) {
+		return nil, ErrBearerTokenInactive
+	}
+	// a configured issuer is required, tokens without iss are rejected
+	if iss, _ := claims["iss"].(string); v.issuer != "" && iss != v.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrBearerTokenInvalid, iss)
+	}
+	if !v.acceptsAudience(claims) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrBearerTokenInvalid)
+	}
+	return claims, nil
+}
+
+// acceptsAudience checks the configured audience of an introspected token.
+// Without audience, the token must be issued for the client of the provider.
+func (v *bearerVerifier) acceptsAudience(claims map[string]any) bool {
+	if v.audience != "" {
+		return audienceContains(claims["aud"], v.audience)
+	}
+	return audienceContains(claims["aud"], v.clientID) || claims["client_id"] == v.clientID || claims["azp"] == v.clientID
+}
+
+// audienceContains checks if the aud claim (a string or an array) contains the audience.
+func audienceContains(aud any, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []any:
+		for _, item := range a {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token of the Authorization header, when it uses the Bearer scheme.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// newBearerAccessContext creates the AccessContext from the claims of a bearer token.
+// The groups are read with the groups claim path from the token claims.
+func newBearerAccessContext(p *Provider, claims map[string]any) *AccessContext {
+	groups, _ := p.groupsClaim.lookup(claims)
+	accessContext := &AccessContext{
+		Provider: p.cfg.Id,
+		Groups:   normalizeGroups(groups),
+		UserInfo: claims,
+	}
+	if sub, ok := claims["sub"].(string); ok {
+		accessContext.Subject = sub
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		accessContext.ExpiresAt = int64(exp)
+	}
+	return accessContext
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestBearerTokenHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		token  string
+		ok     bool
+	}{
+		{"Bearer abc", "abc", true},
+		{"bearer  abc ", "abc", true},
+		{"Basic abc", "", false},
+		{"Bearer", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", test.header)
+		token, ok := bearerToken(req)
+		if token != test.token || ok != test.ok {
+			t.Errorf("unexpected result for %q: got %q/%v, want %q/%v", test.header, token, ok, test.token, test.ok)
+		}
+	}
+}
+
+func TestBearerIntrospection(t *testing.T) {
+	responses := map[string]map[string]any{
+		"active": {
+			"active": true, "sub": "ci", "aud": []any{"artifacts"}, "iss": "https://idp",
+			"exp": float64(time.Now().Add(time.Hour).Unix()), "groups": []any{"staff"},
+		},
+		"inactive":    {"active": false},
+		"expired":     {"active": true, "exp": float64(time.Now().Add(-time.Hour).Unix())},
+		"wrongAud":    {"active": true, "aud": "other"},
+		"wrongIssuer": {"active": true, "aud": "artifacts", "iss": "https://other"},
+		"noIssuer":    {"active": true, "aud": "artifacts"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(responses[r.FormValue("token")])
+	}))
+	defer server.Close()
+
+	v := &bearerVerifier{
+		issuer:                "https://idp",
+		audience:              "artifacts",
+		introspectionEndpoint: server.URL,
+		clientID:              "client",
+		clientSecret:          "secret",
+		client:                server.Client(),
+	}
+
+	claims, err := v.verify(context.Background(), "active")
+	if err != nil {
+		t.Fatalf("failed to introspect token: %v", err)
+	}
+	p := &Provider{cfg: ProviderConfig{OIDCProvider: OIDCProvider{Id: "idp"}}, groupsClaim: claimPath{"groups"}}
+	accessContext := newBearerAccessContext(p, claims)
+	if accessContext.Subject != "ci" || len(accessContext.Groups) != 1 || accessContext.Groups[0] != "staff" {
+		t.Errorf("unexpected access context: %+v", accessContext)
+	}
+
+	for token, expectedErr := range map[string]error{
+		"inactive":    ErrBearerTokenInactive,
+		"expired":     ErrBearerTokenInactive,
+		"wrongAud":    ErrBearerTokenInvalid,
+		"wrongIssuer": ErrBearerTokenInvalid,
+		"noIssuer":    ErrBearerTokenInvalid,
+	} {
+		if _, err := v.verify(context.Background(), token); !errors.Is(err, expectedErr) {
+			t.Errorf("expected error %v for %s, got %v", expectedErr, token, err)
+		}
+	}
+
+	v.clientSecret = "wrong"
+	if _, err := v.verify(context.Background(), "active"); !errors.Is(err, ErrBearerIntrospection) {
+		t.Errorf("expected error %v, got %v", ErrBearerIntrospection, err)
+	}
+}
+
+func TestBearerIntrospectionDefaults(t *testing.T) {
+	responses := map[string]map[string]any{
+		"ownClient":   {"active": true, "iss": "https://idp", "client_id": "client"},
+		"ownAudience": {"active": true, "iss": "https://idp", "aud": []any{"client", "api"}},
+		"otherClient": {"active": true, "iss": "https://idp", "aud": "other", "client_id": "other"},
+		"otherIdP":    {"active": true, "iss": "https://other", "client_id": "client"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(responses[r.FormValue("token")])
+	}))
+	defer server.Close()
+
+	// without audience and issuer, only the tokens of the IdP for this client are accepted
+	v, err := newBearerVerifier(&Provider{
+		cfg: ProviderConfig{
+			OIDCProvider: OIDCProvider{BearerTokens: OIDCBearerTokens{
+				Enabled:               true,
+				Verification:          BearerVerificationIntrospection,
+				IntrospectionEndpoint: server.URL,
+			}},
+			IssuerUrl: "https://idp",
+		},
+		oauth2Config: oauth2.Config{ClientID: "client", ClientSecret: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for token, accepted := range map[string]bool{
+		"ownClient":   true,
+		"ownAudience": true,
+		"otherClient": false,
+		"otherIdP":    false,
+	} {
+		_, err := v.verify(context.Background(), token)
+		if accepted && err != nil {
+			t.Errorf("expected %s to be accepted, got %v", token, err)
+		}
+		if !accepted && !errors.Is(err, ErrBearerTokenInvalid) {
+			t.Errorf("expected error %v for %s, got %v", ErrBearerTokenInvalid, token, err)
+		}
+	}
+}
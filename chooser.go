@@ -0,0 +1,63 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed templates/provider_chooser.html
+var providerChooserHTML string
+
+var providerChooserTemplate = template.Must(template.New("provider_chooser").Parse(providerChooserHTML))
+
+// chooserProvider is one entry on the provider selection page.
+type chooserProvider struct {
+	DisplayName string
+	LogoUrl     string
+	LoginURL    string
+}
+
+// renderProviderChooser renders the provider selection page.
+// Each provider links to its login endpoint, which redirects back to the target after the login.
+func renderProviderChooser(c echo.Context, providers []*Provider, target string) error {
+	data := struct {
+		Providers []chooserProvider
+	}{}
+	for _, provider := range providers {
+		data.Providers = append(data.Providers, chooserProvider{
+			DisplayName: provider.cfg.GetDisplayName(),
+			LogoUrl:     provider.cfg.LogoUrl,
+			LoginURL:    loginURL(provider, target),
+		})
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	c.Response().WriteHeader(http.StatusOK)
+	if err := providerChooserTemplate.Execute(c.Response(), data); err != nil {
+		log.WithError(err).Error("Failed to render provider selection page")
+		return err
+	}
+	return nil
+}
+
+// loginURL returns the url of the login endpoint of the provider, which redirects to the target after the login.
+func loginURL(provider *Provider, target string) string {
+	return "/auth/" + url.PathEscape(provider.cfg.Id) + "/login?redirect=" + url.QueryEscape(target)
+}
+
+// selectProviderURL returns the url of the provider selection page for the providers,
+// which redirects to the target after the login.
+func selectProviderURL(providers []*Provider, target string) string {
+	query := url.Values{"redirect": {target}}
+	for _, provider := range providers {
+		query.Add("provider", provider.cfg.Id)
+	}
+	return "/auth/login?" + query.Encode()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrClaimPathEmpty   = errors.New("claim path is empty")
+	ErrClaimPathInvalid = errors.New("claim path is invalid")
+)
+
+// claimPath is a parsed path to a (nested) claim.
+// Each segment is a key of an object or an index of an array.
+type claimPath []string
+
+// parseClaimPath parses a dotted path like "realm_access.roles" or a simple JSONPath
+// like "$.resource_access['my-client'].roles" or "$.groups[0]".
+// Keys with dots or other special characters must be written in brackets with quotes.
+func parseClaimPath(path string) (claimPath, error) {
+	p := strings.TrimSpace(path)
+	p = strings.TrimPrefix(p, "$")
+	if p == "" {
+		return nil, ErrClaimPathEmpty
+	}
+
+	var segments claimPath
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("%w: %q", ErrClaimPathInvalid, path)
+			}
+			segments = append(segments, p[:end])
+			p = p[end:]
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: %q", ErrClaimPathInvalid, path)
+			}
+			key := p[1:end]
+			if len(key) >= 2 && (key[0] == '\'' || key[0] == '"') && key[len(key)-1] == key[0] {
+				key = key[1 : len(key)-1]
+			} else if _, err := strconv.Atoi(key); err != nil {
+				return nil, fmt.Errorf("%w: %q", ErrClaimPathInvalid, path)
+			}
+			segments = append(segments, key)
+			p = p[end+1:]
+		default:
+			// a path without leading dot
+			p = "." + p
+		}
+	}
+	return segments, nil
+}
+
+// lookup returns the value at the path in the claims.
+func (p claimPath) lookup(claims map[string]any) (any, bool) {
+	var current any = claims
+	for _, segment := range p {
+		switch value := current.(type) {
+		case map[string]any:
+			next, ok := value[segment]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case []any:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(value) {
+				return nil, false
+			}
+			current = value[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// String returns the path in dotted notation.
+func (p claimPath) String() string {
+	return strings.Join(p, ".")
+}
+
+// normalizeGroups converts a claim value into a list of groups.
+// A single string is split by comma, the string and number items of an array are used as is.
+// All values are trimmed and empty values are dropped.
+func normalizeGroups(value any) []string {
+	var groups []string
+	add := func(group string) {
+		group = strings.TrimSpace(group)
+		if group != "" {
+			groups = append(groups, group)
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+	case string:
+		for _, group := range strings.Split(v, ",") {
+			add(group)
+		}
+	case []string:
+		for _, group := range v {
+			add(group)
+		}
+	case []any:
+		// items of arrays are not split, group names like LDAP DNs can contain commas
+		for _, item := range v {
+			switch i := item.(type) {
+			case string:
+				add(i)
+			case float64, int, int64:
+				add(fmt.Sprint(i))
+			}
+		}
+	case bool, map[string]any:
+		// not a valid group value
+	default:
+		add(fmt.Sprint(v))
+	}
+	return groups
+}
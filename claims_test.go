@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestParseClaimPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected claimPath
+	}{
+		{"groups", claimPath{"groups"}},
+		{"realm_access.roles", claimPath{"realm_access", "roles"}},
+		{"$.realm_access.roles", claimPath{"realm_access", "roles"}},
+		{"$.resource_access['my-client'].roles", claimPath{"resource_access", "my-client", "roles"}},
+		{`resource_access["my.client"].roles`, claimPath{"resource_access", "my.client", "roles"}},
+		{"$.groups[0]", claimPath{"groups", "0"}},
+	}
+	for _, test := range tests {
+		path, err := parseClaimPath(test.path)
+		if err != nil {
+			t.Errorf("failed to parse path %q: %v", test.path, err)
+			continue
+		}
+		assert.Equal(t, path, test.expected)
+	}
+
+	for _, invalid := range []string{"a..b", "a[b]", "a['b'", "a."} {
+		_, err := parseClaimPath(invalid)
+		if !errors.Is(err, ErrClaimPathInvalid) {
+			t.Errorf("unexpected error for path %q: got %v, want %v", invalid, err, ErrClaimPathInvalid)
+		}
+	}
+	_, err := parseClaimPath("$")
+	assert.Equal(t, errors.Is(err, ErrClaimPathEmpty), true)
+}
+
+func TestClaimPathLookup(t *testing.T) {
+	claims := map[string]any{
+		"groups": []any{"a", "b"},
+		"realm_access": map[string]any{
+			"roles": []any{"admin"},
+		},
+		"resource_access": map[string]any{
+			"my-client": map[string]any{"roles": "x,y"},
+		},
+	}
+
+	lookup := func(path string) any {
+		p, err := parseClaimPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := p.lookup(claims)
+		return value
+	}
+
+	assert.Equal(t, lookup("groups"), []any{"a", "b"})
+	assert.Equal(t, lookup("groups[1]"), "b")
+	assert.Equal(t, lookup("realm_access.roles"), []any{"admin"})
+	assert.Equal(t, lookup("$.resource_access['my-client'].roles"), "x,y")
+	assert.Equal(t, lookup("groups[2]"), nil)
+	assert.Equal(t, lookup("missing.path"), nil)
+	assert.Equal(t, lookup("groups.roles"), nil)
+}
+
+func TestNormalizeGroups(t *testing.T) {
+	assert.Equal(t, normalizeGroups("a, b,,c"), []string{"a", "b", "c"})
+	assert.Equal(t, normalizeGroups([]any{"cn=ops,ou=groups", " x ", 42.0, true}), []string{"cn=ops,ou=groups", "x", "42"})
+	assert.Equal(t, normalizeGroups([]string{"a", ""}), []string{"a"})
+	assert.Equal(t, len(normalizeGroups(nil)), 0)
+	assert.Equal(t, len(normalizeGroups(map[string]any{"a": "b"})), 0)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrClientCertCA       = errors.New("invalid client CA file")
+	ErrClientCertSettings = errors.New("invalid TLS client auth settings")
+)
+
+const CredentialTypeClientCert = "client_cert"
+
+// field of the certificate, which is the subject of the user, when no field is configured
+const defaultClientCertSubject = "common_name"
+
+// applyClientAuth configures the verification of the client certificates.
+// The ACME TLS-ALPN challenge of AutoTLS sends no client certificate, so it is not required for a connection,
+// which only offers the challenge protocol. Such a connection can not use HTTP.
+func applyClientAuth(tlsConfig *tls.Config, settings SettingsTLS) error {
+	clientAuth, err := settings.GetClientAuth()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrClientCertSettings, err)
+	}
+	if clientAuth == tls.NoClientCert {
+		return nil
+	}
+	if settings.ClientCAFile == "" {
+		return fmt.Errorf("%w: client auth %s requires a client CA file", ErrClientCertSettings, settings.ClientAuth)
+	}
+	clientCAs, err := loadClientCAs(settings.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig.ClientAuth = clientAuth
+	tlsConfig.ClientCAs = clientCAs
+	if !settings.AutoTLS {
+		return nil
+	}
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !slices.Equal(hello.SupportedProtos, []string{acme.ALPNProto}) {
+			return nil, nil
+		}
+		challengeConfig := tlsConfig.Clone()
+		challengeConfig.ClientAuth = tls.NoClientCert
+		challengeConfig.NextProtos = []string{acme.ALPNProto}
+		challengeConfig.GetConfigForClient = nil
+		return challengeConfig, nil
+	}
+	return nil
+}
+
+// checkClientAuth checks the client certificate settings before the server starts.
+// Without client auth, the client certificate providers can not authenticate any request.
+func checkClientAuth(cfg *Config) error {
+	settings := cfg.Settings.TLS
+	clientAuth, err := settings.GetClientAuth()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrClientCertSettings, err)
+	}
+	if clientAuth == tls.NoClientCert {
+		if len(cfg.Content.ClientCerts) > 0 {
+			log.Warn("Client certificate providers are configured, but TLS_CLIENT_AUTH is none")
+		}
+		return nil
+	}
+	if !settings.Enabled {
+		return fmt.Errorf("%w: client auth %s requires TLS", ErrClientCertSettings, settings.ClientAuth)
+	}
+	return applyClientAuth(&tls.Config{}, settings)
+}
+
+// loadClientCAs reads the PEM encoded CAs of the client certificates.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrClientCertCA, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("%w: no certificates in %s", ErrClientCertCA, path)
+	}
+	return pool, nil
+}
+
+// clientCertProvider maps the verified client certificate of the TLS connection to a user.
+// The organizational units of the certificate are the groups of the user.
+type clientCertProvider struct {
+	id      string
+	subject string
+	groups  map[string][]string
+}
+
+func newClientCertProvider(cfg ClientCertProvider) *clientCertProvider {
+	subject := cfg.Subject
+	if subject == "" {
+		subject = defaultClientCertSubject
+	}
+	return &clientCertProvider{id: cfg.Id, subject: subject, groups: cfg.Groups}
+}
+
+func (p *clientCertProvider) authenticate(r *http.Request) (*AccessContext, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, nil
+	}
+	// the chain is only verified, when TLS_CLIENT_AUTH is request or require
+	if len(r.TLS.VerifiedChains) == 0 {
+		return nil, fmt.Errorf("%w: client certificate is not verified", ErrCredentialInvalid)
+	}
+	cert := r.TLS.PeerCertificates[0]
+	name := p.subjectOf(cert)
+	if name == "" {
+		return nil, fmt.Errorf("%w: client certificate %s has no %s", ErrCredentialInvalid, cert.Subject, p.subject)
+	}
+
+	groups := append(slices.Clone(cert.Subject.OrganizationalUnit), p.groups[name]...)
+	accessContext := newCredentialAccessContext(p.id, CredentialTypeClientCert, name, groups)
+	if len(cert.EmailAddresses) > 0 {
+		accessContext.UserInfo["email"] = cert.EmailAddresses[0]
+	}
+	accessContext.UserInfo["certificate"] = clientCertInfo(cert)
+	return accessContext, nil
+}
+
+// challenge sets no header, the certificate is requested by the TLS handshake.
+func (p *clientCertProvider) challenge(http.Header) {}
+
+// subjectOf returns the configured field of the certificate, for SANs the first entry.
+func (p *clientCertProvider) subjectOf(cert *x509.Certificate) string {
+	switch p.subject {
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// clientCertInfo returns the fields of the certificate for the expressions and the upstreams.
+func clientCertInfo(cert *x509.Certificate) map[string]any {
+	uris := make([]any, len(cert.URIs))
+	for i, uri := range cert.URIs {
+		uris[i] = uri.String()
+	}
+	return map[string]any{
+		"subject":              cert.Subject.String(),
+		"issuer":               cert.Issuer.String(),
+		"serial_number":        cert.SerialNumber.String(),
+		"common_name":          cert.Subject.CommonName,
+		"organization":         toAnySlice(cert.Subject.Organization),
+		"organizational_units": toAnySlice(cert.Subject.OrganizationalUnit),
+		"dns_names":            toAnySlice(cert.DNSNames),
+		"email_addresses":      toAnySlice(cert.EmailAddresses),
+		"uris":                 uris,
+		"not_after":            cert.NotAfter.UTC().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/acme"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue creates a client certificate with the subject and SANs of the template.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) writeFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "client-ca.pem")
+	if err := os.WriteFile(path, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyClientAuth(t *testing.T) {
+	caFile := newTestCA(t, "Build Agents CA").writeFile(t)
+
+	tlsConfig := &tls.Config{}
+	assert.Equal(t, applyClientAuth(tlsConfig, SettingsTLS{ClientAuth: "none"}), nil)
+	assert.Equal(t, tlsConfig.ClientAuth, tls.NoClientCert)
+	assert.Equal(t, tlsConfig.ClientCAs == nil, true)
+
+	assert.Equal(t, applyClientAuth(tlsConfig, SettingsTLS{ClientAuth: "require", ClientCAFile: caFile}), nil)
+	assert.Equal(t, tlsConfig.ClientAuth, tls.RequireAndVerifyClientCert)
+	assert.Equal(t, tlsConfig.ClientCAs != nil, true)
+	// without AutoTLS there is no ACME challenge
+	assert.Equal(t, tlsConfig.GetConfigForClient == nil, true)
+
+	// the ACME challenge is answered without client certificate, but only for the challenge protocol
+	tlsConfig = &tls.Config{NextProtos: []string{acme.ALPNProto, "h2", "http/1.1"}}
+	assert.Equal(t, applyClientAuth(tlsConfig, SettingsTLS{AutoTLS: true, ClientAuth: "require", ClientCAFile: caFile}), nil)
+	challengeConfig, err := tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, challengeConfig.ClientAuth, tls.NoClientCert)
+	assert.Equal(t, challengeConfig.NextProtos, []string{acme.ALPNProto})
+	for _, protos := range [][]string{{"h2"}, {acme.ALPNProto, "h2"}, {"h2", acme.ALPNProto}} {
+		challengeConfig, err = tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: protos})
+		assert.Equal(t, err, nil)
+		assert.Equal(t, challengeConfig == nil, true)
+	}
+
+	tlsConfig = &tls.Config{}
+	assert.Equal(t, applyClientAuth(tlsConfig, SettingsTLS{ClientAuth: "request", ClientCAFile: caFile}), nil)
+	assert.Equal(t, tlsConfig.ClientAuth, tls.VerifyClientCertIfGiven)
+
+	err = applyClientAuth(&tls.Config{}, SettingsTLS{ClientAuth: "request"})
+	assert.Equal(t, errors.Is(err, ErrClientCertSettings), true)
+	err = applyClientAuth(&tls.Config{}, SettingsTLS{ClientAuth: "optional", ClientCAFile: caFile})
+	assert.Equal(t, errors.Is(err, ErrClientCertSettings), true)
+	err = applyClientAuth(&tls.Config{}, SettingsTLS{ClientAuth: "require", ClientCAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Equal(t, errors.Is(err, ErrClientCertCA), true)
+
+	// client auth requires TLS
+	err = checkClientAuth(&Config{Settings: Settings{TLS: SettingsTLS{ClientAuth: "require", ClientCAFile: caFile}}})
+	assert.Equal(t, errors.Is(err, ErrClientCertSettings), true)
+	err = checkClientAuth(&Config{Settings: Settings{TLS: SettingsTLS{Enabled: true, ClientAuth: "require", ClientCAFile: caFile}}})
+	assert.Equal(t, err, nil)
+}
+
+func TestClientAuthHandshake(t *testing.T) {
+	ca := newTestCA(t, "Build Agents CA")
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "localhost"}})},
+		NextProtos:   []string{acme.ALPNProto, "h2", "http/1.1"},
+	}
+	err := applyClientAuth(tlsConfig, SettingsTLS{AutoTLS: true, ClientAuth: "require", ClientCAFile: ca.writeFile(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				if conn.(*tls.Conn).Handshake() == nil {
+					_, _ = conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+
+	// handshake connects without client certificate and returns the negotiated protocol.
+	// With TLS 1.3 the missing certificate is only reported after the handshake, so the answer is read.
+	handshake := func(protos ...string) (string, error) {
+		t.Helper()
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: protos})
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = conn.Close() }()
+		if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+			return "", err
+		}
+		return conn.ConnectionState().NegotiatedProtocol, nil
+	}
+
+	protocol, err := handshake(acme.ALPNProto)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, protocol, acme.ALPNProto)
+	// the challenge protocol can not be used to skip the client certificate for HTTP
+	_, err = handshake(acme.ALPNProto, "h2")
+	assert.NotEqual(t, err, nil)
+	_, err = handshake("h2")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestClientCertProvider(t *testing.T) {
+	ca := newTestCA(t, "Build Agents CA")
+	otherCA := newTestCA(t, "Other CA")
+	cfg := &Config{
+		Settings: Settings{Session: SettingsSession{Key: "secret"}},
+		Content: ContentConfig{
+			ClientCerts: []ClientCertProvider{
+				{Id: "agents", Groups: map[string][]string{"agent-2": {"release"}}},
+				{Id: "spiffe", Subject: "uri"},
+			},
+		},
+	}
+	o, err := New(Providers{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := AccessPolicies{}.Compile(&StaticPageProtection{
+		Providers:  []string{"agents"},
+		Groups:     []string{"build"},
+		Expression: `user.certificate.issuer == "CN=Build Agents CA"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware, err := o.CreateMiddleware(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.GET("/*", func(c echo.Context) error {
+		accessContext := c.Get(accessContextKey).(*AccessContext)
+		return c.String(http.StatusOK, accessContext.Provider+":"+accessContext.Subject)
+	}, middleware)
+
+	server := httptest.NewUnstartedServer(e)
+	server.TLS = &tls.Config{}
+	if err := applyClientAuth(server.TLS, SettingsTLS{ClientAuth: "request", ClientCAFile: ca.writeFile(t)}); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	request := func(cert *tls.Certificate) (int, string) {
+		t.Helper()
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			// always send the certificate, also when the server does not accept its CA
+			transport.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return cert, nil
+			}
+		}
+		res, err := (&http.Client{Transport: transport}).Get(server.URL + "/artifacts/build.zip")
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer func() { _ = res.Body.Close() }()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	agent := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "agent-1", OrganizationalUnit: []string{"build"}}})
+	status, body := request(&agent)
+	assert.Equal(t, status, http.StatusOK)
+	assert.Equal(t, body, "agents:agent-1")
+
+	// groups of the subject are added to the organizational units
+	release := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "agent-2"}})
+	status, _ = request(&release)
+	assert.Equal(t, status, http.StatusForbidden)
+
+	status, _ = request(nil)
+	assert.Equal(t, status, http.StatusUnauthorized)
+
+	// the handshake fails for certificates of other CAs
+	foreign := otherCA.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "agent-1", OrganizationalUnit: []string{"build"}}})
+	status, _ = request(&foreign)
+	assert.Equal(t, status, 0)
+
+	// mapping of the certificate fields
+	releaseLeaf, err := x509.ParseCertificate(release.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseState := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{releaseLeaf},
+		VerifiedChains:   [][]*x509.Certificate{{releaseLeaf, ca.cert}},
+	}
+	accessContext, err := o.credentials["agents"].authenticate(&http.Request{TLS: releaseState})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, accessContext.Subject, "agent-2")
+	assert.Equal(t, accessContext.Groups, []string{"release"})
+	assert.Equal(t, accessContext.UserInfo["auth_type"], CredentialTypeClientCert)
+
+	spiffeId, _ := url.Parse("spiffe://example.com/agent/3")
+	workload := ca.issue(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "agent-3", OrganizationalUnit: []string{"build", "deploy"}},
+		EmailAddresses: []string{"agent-3@example.com"},
+		URIs:           []*url.URL{spiffeId},
+	})
+	leaf, err := x509.ParseCertificate(workload.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}, VerifiedChains: [][]*x509.Certificate{{leaf, ca.cert}}}
+	accessContext, err = o.credentials["spiffe"].authenticate(&http.Request{TLS: state})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, accessContext.Subject, "spiffe://example.com/agent/3")
+	assert.Equal(t, accessContext.Groups, []string{"build", "deploy"})
+	assert.Equal(t, accessContext.UserInfo["email"], "agent-3@example.com")
+
+	// the certificate has no configured subject field
+	_, err = o.credentials["spiffe"].authenticate(&http.Request{TLS: releaseState})
+	assert.Equal(t, errors.Is(err, ErrCredentialInvalid), true)
+	state.VerifiedChains = nil
+	_, err = o.credentials["spiffe"].authenticate(&http.Request{TLS: state})
+	assert.Equal(t, errors.Is(err, ErrCredentialInvalid), true)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -17,6 +19,14 @@ import (
 
 // --- Config type declaration ---
 
+const (
+	defaultTransactionTTL      = 10 * time.Minute
+	defaultUpstreamDialTimeout = 10 * time.Second
+	defaultUpstreamTimeout     = 30 * time.Second
+	defaultShareLinkTTL        = 24 * time.Hour
+	defaultShareLinkMaxTTL     = 7 * 24 * time.Hour
+)
+
 // Config is the main configuration struct containing settings and content config
 type Config struct {
 	// contains the main settings for the webserver
@@ -32,10 +42,29 @@ type Settings struct {
 	TLS        SettingsTLS     `env-prefix:"TLS_"`
 	Session    SettingsSession `env-prefix:"SESSION_"`
 	ConfigPath string          `env:"CONFIG_PATH" env-default:"/etc/oauth-resource-proxy/config.yaml"`
+	// IPs or CIDRs of the reverse proxies, which are trusted to set the client IP
+	TrustedProxies []string `env:"TRUSTED_PROXIES" env-separator:"," env-description:"Comma separated IPs or CIDRs of trusted reverse proxies"`
+	// Possible values: "X-Forwarded-For", "Forwarded", "X-Real-IP"
+	ClientIPHeader string `env:"CLIENT_IP_HEADER" env-default:"X-Forwarded-For" env-description:"Header with the client IP, which the trusted proxies set: X-Forwarded-For, Forwarded or X-Real-IP"`
+	// read the client address from the PROXY protocol header of the trusted proxies
+	ProxyProtocol bool               `env:"PROXY_PROTOCOL" env-default:"false" env-description:"Accept the PROXY protocol (v1 and v2) from the trusted proxies"`
+	Expression    SettingsExpression `env-prefix:"EXPRESSION_"`
+}
+
+type SettingsExpression struct {
+	// headers, which are available in the request variable of the expressions
+	RequestHeaders []string `env:"REQUEST_HEADERS" env-separator:"," env-default:"Accept,Accept-Language,Origin,Referer,User-Agent"`
+	// maximum length of strings and bytes in the expressions
+	MaxStringLength int `env:"MAX_STRING_LENGTH" env-default:"1048576"`
+	MaxBytesLength  int `env:"MAX_BYTES_LENGTH" env-default:"1048576"`
 }
 
 type SettingsSession struct {
 	Key string `env:"KEY"`
+	// Possible values: "lax", "strict", "none"
+	CookieSameSite string `env:"COOKIE_SAME_SITE" env-default:"lax" env-description:"SameSite attribute of the session cookie: lax, strict or none"`
+	// share the session with other subdomains, e.g. for the forward auth
+	CookieDomain string `env:"COOKIE_DOMAIN" env-description:"Domain attribute of the session cookie"`
 	// Possible values: "filesystem", "redis"
 	StoreDriver string `env:"STORE_DRIVER" env-default:"filesystem" env-description:"Session store driver: filesystem or redis"`
 	// when redis
@@ -71,16 +100,31 @@ type SettingsTLS struct {
 	KeyFile             string `env:"KEY_FILE"`
 	AutoTLS             bool   `env:"AUTO_TLS" env-default:"false"`
 	AutoTLSCertCacheDir string `env:"AUTO_TLS_CERT_CACHE_DIR"`
+	// CA bundle (PEM) to verify the client certificates
+	ClientCAFile string `env:"CLIENT_CA_FILE" env-description:"PEM file with the CAs of the client certificates"`
+	// Possible values: "none", "request", "require"
+	ClientAuth string `env:"CLIENT_AUTH" env-default:"none" env-description:"Client certificates: none, request (verified when sent) or require"`
 }
 
 type ContentConfig struct {
-	OIDC        ContentConfigOIDC `yaml:"oidc" validate:"required"`
-	StaticPages []StaticPage      `yaml:"static_pages" validate:"dive,required"`
+	OIDC ContentConfigOIDC `yaml:"oidc" validate:"required"`
+	// machine accounts, which protections reference by id like the OIDC providers
+	BasicAuth   []BasicAuthProvider  `yaml:"basic_auth" validate:"dive"`
+	APIKeys     []APIKeyProvider     `yaml:"api_keys" validate:"dive"`
+	ClientCerts []ClientCertProvider `yaml:"client_certs" validate:"dive"`
+	Policies    []NamedPolicy        `yaml:"policies" validate:"dive"`
+	StaticPages []StaticPage         `yaml:"static_pages" validate:"dive,required"`
 }
 
 type ContentConfigOIDC struct {
 	BaseUrl   string         `yaml:"base_url" validate:"required,url"`
 	Providers []OIDCProvider `yaml:"providers" validate:"dive,required"`
+	// target after logout, defaults to the base url
+	PostLogoutRedirectUri string `yaml:"post_logout_redirect_uri" validate:"omitempty,url"`
+	// maximum time between the redirect to the IdP and the callback, defaults to 10 minutes
+	TransactionTTL time.Duration `yaml:"transaction_ttl" validate:"gte=0"`
+	// hosts, which are allowed as absolute redirect target after the login
+	AllowedRedirectHosts []string `yaml:"allowed_redirect_hosts" validate:"dive,required"`
 }
 
 type OIDCProvider struct {
@@ -88,19 +132,178 @@ type OIDCProvider struct {
 	ConfigUrl    string `yaml:"config_url" validate:"required,url"`
 	ClientID     string `yaml:"client_id" validate:"alphanum"`
 	ClientSecret string `yaml:"client_secret" validate:"alphanum"`
+	// use PKCE (S256) for the authorization code flow, defaults to true
+	PKCE *bool `yaml:"pkce"`
+	// request the offline_access scope to get a refresh token
+	OfflineAccess bool `yaml:"offline_access"`
+	// requested scopes, defaults to openid, profile, email and groups
+	Scopes []string `yaml:"scopes" validate:"dive,required"`
+	// additional parameters for the auth request, e.g. prompt, login_hint or audience
+	ExtraAuthParams map[string]string `yaml:"extra_auth_params" validate:"dive,keys,required,endkeys"`
+	// response mode of the auth request, form_post requires SESSION_COOKIE_SAME_SITE=none
+	ResponseMode string `yaml:"response_mode" validate:"omitempty,oneof=query form_post"`
+	// where to find the groups of the user
+	GroupsClaim OIDCGroupsClaim `yaml:"groups_claim"`
+	// accept access tokens in the Authorization header
+	BearerTokens OIDCBearerTokens `yaml:"bearer_tokens"`
+	// shown on the provider selection page, the display name defaults to the id
+	DisplayName string `yaml:"display_name"`
+	LogoUrl     string `yaml:"logo_url" validate:"omitempty,url"`
+}
+
+// GetDisplayName returns the display name or the id, if no display name is configured.
+func (p OIDCProvider) GetDisplayName() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	return p.Id
+}
+
+type OIDCBearerTokens struct {
+	Enabled bool `yaml:"enabled"`
+	// Possible values: "jwt" (verified with the JWKS of the IdP), "introspection" (RFC 7662), defaults to "jwt"
+	Verification string `yaml:"verification" validate:"omitempty,oneof=jwt introspection"`
+	// required audience of the tokens, the client id of the provider for JWTs when empty
+	Audience string `yaml:"audience"`
+	// required issuer of the tokens, defaults to the issuer of the IdP
+	Issuer string `yaml:"issuer"`
+	// defaults to the introspection_endpoint of the IdP
+	IntrospectionEndpoint string `yaml:"introspection_endpoint" validate:"omitempty,url"`
+}
+
+type BasicAuthProvider struct {
+	Id string `yaml:"id" validate:"alphanum"`
+	// htpasswd file with bcrypt or argon2 hashes
+	HtpasswdFile string `yaml:"htpasswd_file" validate:"required,file"`
+	// realm of the WWW-Authenticate header, defaults to the id
+	Realm string `yaml:"realm"`
+	// user name -> groups of the user
+	Groups map[string][]string `yaml:"groups" validate:"dive,keys,required,endkeys,dive,required"`
+}
+
+type APIKeyProvider struct {
+	Id string `yaml:"id" validate:"alphanum"`
+	// header with the key, defaults to X-API-Key
+	Header string   `yaml:"header"`
+	Keys   []APIKey `yaml:"keys" validate:"required,dive"`
+}
+
+type APIKey struct {
+	// subject of the requests with the key
+	Name string `yaml:"name" validate:"required"`
+	// SHA-256 ("sha256:<hex>"), bcrypt or argon2 hash of the key
+	Hash   string   `yaml:"hash" validate:"required"`
+	Groups []string `yaml:"groups" validate:"dive,required"`
+}
+
+// ClientCertProvider authenticates the requests with the client certificates of the TLS connection.
+type ClientCertProvider struct {
+	Id string `yaml:"id" validate:"alphanum"`
+	// Possible values: "common_name", "email", "dns", "uri", defaults to "common_name"
+	Subject string `yaml:"subject" validate:"omitempty,oneof=common_name email dns uri"`
+	// subject -> additional groups, the organizational units are always groups
+	Groups map[string][]string `yaml:"groups" validate:"dive,keys,required,endkeys,dive,required"`
+}
+
+type OIDCGroupsClaim struct {
+	// dotted path or JSONPath to the claim, defaults to "groups"
+	Path string `yaml:"path"`
+	// Possible values: "id_token", "userinfo", "access_token", defaults to "id_token"
+	Source string `yaml:"source" validate:"omitempty,oneof=id_token userinfo access_token"`
 }
 
 type StaticPage struct {
 	Id         string                `yaml:"id" validate:"alphanum"`
-	Dir        string                `yaml:"dir" validate:"dir"`
+	Dir        string                `yaml:"dir" validate:"required_without=Upstream,excluded_with=Upstream,omitempty,dir"`
 	Url        string                `yaml:"url" validate:"required,uri"`
 	Protection *StaticPageProtection `yaml:"protection"`
+	// ordered rules for sub paths of the page, the first matching rule wins
+	Rules []StaticPageRule `yaml:"rules" validate:"dive"`
+	// proxy the page to a backend instead of serving the dir
+	Upstream *StaticPageUpstream `yaml:"upstream"`
+	// hand out the access tokens of the session to the page
+	Token *StaticPageToken `yaml:"token"`
+	// signed links, which grant access to a path of the page without a session
+	ShareLinks *StaticPageShareLinks `yaml:"share_links"`
+}
+
+type StaticPageShareLinks struct {
+	Enabled bool `yaml:"enabled"`
+	// lifetime of a link, when the request does not set one, defaults to 24 hours
+	DefaultTTL time.Duration `yaml:"default_ttl" validate:"gte=0"`
+	// maximum lifetime of a link, defaults to 7 days
+	MaxTTL time.Duration `yaml:"max_ttl" validate:"gte=0"`
+}
+
+type StaticPageToken struct {
+	// enables the token endpoint for the page
+	Endpoint bool `yaml:"endpoint"`
+	// proxy routes, which attach the access token to the requests
+	Relay []StaticPageTokenRelay `yaml:"relay" validate:"dive"`
+}
+
+type StaticPageTokenRelay struct {
+	// path relative to the url of the page, e.g. "/api"
+	Path string `yaml:"path" validate:"required"`
+	// provider of the access token, defaults to the first provider of the page
+	Provider           string `yaml:"provider" validate:"omitempty,alphanum"`
+	StaticPageUpstream `yaml:",inline"`
+}
+
+type StaticPageUpstream struct {
+	Url string `yaml:"url" validate:"required,url"`
+	// remove the url of the page from the proxied path
+	StripPath bool `yaml:"strip_path"`
+	// send the user as X-Auth-Request-* headers
+	PassIdentity bool `yaml:"pass_identity"`
+	// header name -> claim path of the user, e.g. X-Email: email
+	IdentityHeaders map[string]string `yaml:"identity_headers" validate:"dive,keys,required,endkeys,required"`
+	// timeout for the connection and for the response headers of the backend
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// StaticPageRule replaces the protection of the page for all paths matching the glob.
+// A rule is either public or has a protection.
+type StaticPageRule struct {
+	// glob relative to the url of the page, e.g. "/assets/**"
+	Path       string                `yaml:"path" validate:"required"`
+	Public     bool                  `yaml:"public"`
+	Protection *StaticPageProtection `yaml:"protection"`
+}
+
+// NamedPolicy is a reusable protection, which pages and other policies can reference by its id.
+type NamedPolicy struct {
+	Id                   string `yaml:"id" validate:"required"`
+	StaticPageProtection `yaml:",inline"`
 }
 
 type StaticPageProtection struct {
-	Provider   string   `yaml:"provider" validate:"alphanum"`
+	Provider string `yaml:"provider" validate:"omitempty,alphanum"`
+	// a session of any of these providers is accepted, can be combined with provider
+	Providers  []string `yaml:"providers" validate:"dive,alphanum"`
 	Expression string   `yaml:"expression"`
-	Groups     []string `yaml:"groups" validate:"dive,alphanum"`
+	// group names or patterns ("*" and "?" globs or "regex:" prefixed regular expressions)
+	Groups []string `yaml:"groups" validate:"dive,required"`
+	// all groups must match instead of one
+	RequireAll bool `yaml:"require_all"`
+	// users with a group matching one of these patterns are always denied
+	DenyGroups []string `yaml:"deny_groups" validate:"dive,required"`
+	// id of a named policy, which must also be fulfilled
+	Policy string `yaml:"policy"`
+	// composition of rules, which are evaluated against the same user
+	AllOf []StaticPageProtection `yaml:"all_of" validate:"dive"`
+	AnyOf []StaticPageProtection `yaml:"any_of" validate:"dive"`
+	Not   *StaticPageProtection  `yaml:"not"`
+	// client IPs or CIDRs, only requests from these networks are allowed
+	AllowCIDRs []string `yaml:"allow_cidrs" validate:"dive,cidr|ip"`
+	// client IPs or CIDRs, requests from these networks are always denied
+	DenyCIDRs []string `yaml:"deny_cidrs" validate:"dive,cidr|ip"`
+	// client IPs or CIDRs, requests from these networks are allowed without login
+	BypassAuthFrom []string `yaml:"bypass_auth_from" validate:"dive,cidr|ip"`
+	// limits of the expression evaluation, defaults to 100ms and 10000 allocations
+	ExpressionTimeout   time.Duration `yaml:"expression_timeout" validate:"gte=0"`
+	ExpressionMaxAllocs int64         `yaml:"expression_max_allocs" validate:"gte=0"`
 }
 
 // --- Config loading and processing ---
@@ -155,6 +358,9 @@ func LoadAndProcessConfig() (*Config, error) {
 		log.WithError(err).Error("Error resolving config")
 		return nil, err
 	}
+
+	expression := cfg.Settings.Expression
+	setExpressionLengthLimits(expression.MaxStringLength, expression.MaxBytesLength)
 	return cfg, nil
 }
 
@@ -176,6 +382,32 @@ func (s Settings) GetWSAddress() string {
 	return fmt.Sprintf("%s:%d", s.Host.Address, s.Host.Port)
 }
 
+// GetSameSite converts the configured SameSite attribute of the session cookie.
+func (s SettingsSession) GetSameSite() (http.SameSite, error) {
+	switch strings.ToLower(s.CookieSameSite) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return http.SameSiteDefaultMode, fmt.Errorf("invalid cookie SameSite attribute: %s", s.CookieSameSite)
+}
+
+// GetClientAuth converts the configured client certificate mode. The certificates are always verified with the CAs.
+func (s SettingsTLS) GetClientAuth() (tls.ClientAuthType, error) {
+	switch strings.ToLower(s.ClientAuth) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("invalid TLS client auth: %s", s.ClientAuth)
+}
+
 // GetHttps2Server builds a http2.Server from the settings
 func (s SettingsHTTP2) GetHttps2Server() *http2.Server {
 	return &http2.Server{
@@ -185,6 +417,39 @@ func (s SettingsHTTP2) GetHttps2Server() *http2.Server {
 	}
 }
 
+// ExpressionLimits returns the configured limits for the expression evaluation.
+func (p *StaticPageProtection) ExpressionLimits() ExpressionLimits {
+	return ExpressionLimits{
+		Timeout:   p.ExpressionTimeout,
+		MaxAllocs: p.ExpressionMaxAllocs,
+	}
+}
+
+// setDefaults sets the default timeouts.
+func (u *StaticPageUpstream) setDefaults() {
+	if u.DialTimeout == 0 {
+		u.DialTimeout = defaultUpstreamDialTimeout
+	}
+	if u.Timeout == 0 {
+		u.Timeout = defaultUpstreamTimeout
+	}
+}
+
+// setDefaults sets the default lifetimes, the default lifetime is limited by the maximum.
+func (s *StaticPageShareLinks) setDefaults() {
+	if s.MaxTTL == 0 {
+		s.MaxTTL = defaultShareLinkMaxTTL
+	}
+	if s.DefaultTTL == 0 {
+		s.DefaultTTL = min(defaultShareLinkTTL, s.MaxTTL)
+	}
+}
+
+// PKCEEnabled reports if PKCE should be used, which is the default when not configured.
+func (p OIDCProvider) PKCEEnabled() bool {
+	return p.PKCE == nil || *p.PKCE
+}
+
 func (c *ContentConfig) Validate(validate *validator.Validate) error {
 	err := validateStruct(validate, c)
 	if err != nil {
@@ -205,6 +470,29 @@ func (c *ContentConfig) Validate(validate *validator.Validate) error {
 
 func (c *ContentConfig) Process() error {
 	c.OIDC.BaseUrl = strings.TrimRight(c.OIDC.BaseUrl, "/")
+	if c.OIDC.PostLogoutRedirectUri == "" {
+		c.OIDC.PostLogoutRedirectUri = c.OIDC.BaseUrl + "/"
+	}
+	if c.OIDC.TransactionTTL == 0 {
+		c.OIDC.TransactionTTL = defaultTransactionTTL
+	}
+	for _, page := range c.StaticPages {
+		if page.Upstream != nil {
+			page.Upstream.setDefaults()
+		}
+		if page.Token != nil {
+			for i := range page.Token.Relay {
+				page.Token.Relay[i].setDefaults()
+			}
+		}
+		if page.ShareLinks != nil {
+			page.ShareLinks.setDefaults()
+			if page.ShareLinks.DefaultTTL > page.ShareLinks.MaxTTL {
+				return fmt.Errorf("static page %q: share link default_ttl %s exceeds max_ttl %s",
+					page.Id, page.ShareLinks.DefaultTTL, page.ShareLinks.MaxTTL)
+			}
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrCredentialInvalid         = errors.New("credentials are invalid")
+	ErrCredentialHashUnsupported = errors.New("unsupported hash")
+	ErrCredentialHashInvalid     = errors.New("hash is malformed")
+	ErrCredentialHtpasswd        = errors.New("invalid htpasswd file")
+	ErrCredentialDuplicate       = errors.New("provider id is used more than once")
+)
+
+const (
+	CredentialTypeBasic  = "basic"
+	CredentialTypeAPIKey = "api_key"
+)
+
+// header of the API keys, when no header is configured
+const defaultAPIKeyHeader = "X-API-Key"
+
+// maximum memory of an argon2 hash in KiB (256 MiB), more memory per login would exhaust the server
+const maxArgon2Memory = 256 * 1024
+
+// bcrypt hash with the default cost, which is checked for unknown users,
+// so the response time does not reveal which users exist
+var unknownUserHash = bcryptHash("$2a$10$zv7tr6juunmzzgwMHmafhuFDAENTyAWyo.yT68gJPyWk6bGsr.NLG")
+
+// credentialProvider authenticates machine accounts with the credentials sent in the request or the TLS connection.
+// Protections reference them by id like the OIDC providers.
+type credentialProvider interface {
+	// authenticate returns nil without error, when the request carries no credentials for the provider
+	authenticate(r *http.Request) (*AccessContext, error)
+	// challenge sets the WWW-Authenticate header of a 401 response
+	challenge(header http.Header)
+}
+
+// newCredentialProviders creates the basic auth, API key and client certificate providers.
+// The ids must be unique, also across the OIDC providers.
+func newCredentialProviders(cfg *ContentConfig) (map[string]credentialProvider, error) {
+	ids := make(map[string]bool)
+	for _, provider := range cfg.OIDC.Providers {
+		ids[provider.Id] = true
+	}
+	checkId := func(id string) error {
+		if ids[id] {
+			return fmt.Errorf("%w: %s", ErrCredentialDuplicate, id)
+		}
+		ids[id] = true
+		return nil
+	}
+
+	providers := make(map[string]credentialProvider)
+	for _, basicCfg := range cfg.BasicAuth {
+		if err := checkId(basicCfg.Id); err != nil {
+			return nil, err
+		}
+		provider, err := newBasicAuthProvider(basicCfg)
+		if err != nil {
+			return nil, fmt.Errorf("basic auth provider %s: %w", basicCfg.Id, err)
+		}
+		providers[basicCfg.Id] = provider
+	}
+	for _, apiKeyCfg := range cfg.APIKeys {
+		if err := checkId(apiKeyCfg.Id); err != nil {
+			return nil, err
+		}
+		provider, err := newAPIKeyProvider(apiKeyCfg)
+		if err != nil {
+			return nil, fmt.Errorf("API key provider %s: %w", apiKeyCfg.Id, err)
+		}
+		providers[apiKeyCfg.Id] = provider
+	}
+	for _, clientCertCfg := range cfg.ClientCerts {
+		if err := checkId(clientCertCfg.Id); err != nil {
+			return nil, err
+		}
+		providers[clientCertCfg.Id] = newClientCertProvider(clientCertCfg)
+	}
+	return providers, nil
+}
+
+// newCredentialAccessContext creates the synthetic AccessContext of a machine account.
+// The name is the subject and the preferred_username of the user.
+func newCredentialAccessContext(providerId, credentialType, name string, groups []string) *AccessContext {
+	return &AccessContext{
+		Provider: providerId,
+		Subject:  name,
+		Groups:   groups,
+		UserInfo: map[string]any{
+			"sub":                name,
+			"preferred_username": name,
+			"groups":             toAnySlice(groups),
+			"auth_type":          credentialType,
+		},
+	}
+}
+
+// toAnySlice converts the strings for the user info, like the claims of an IdP.
+func toAnySlice(values []string) []any {
+	result := make([]any, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
+
+// basicAuthProvider checks HTTP Basic credentials against the users of a htpasswd file.
+type basicAuthProvider struct {
+	id     string
+	realm  string
+	users  map[string]secretHash
+	groups map[string][]string
+}
+
+func newBasicAuthProvider(cfg BasicAuthProvider) (*basicAuthProvider, error) {
+	users, err := readHtpasswd(cfg.HtpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	realm := cfg.Realm
+	if realm == "" {
+		realm = cfg.Id
+	}
+	return &basicAuthProvider{
+		id:     cfg.Id,
+		realm:  realm,
+		users:  users,
+		groups: cfg.Groups,
+	}, nil
+}
+
+func (p *basicAuthProvider) authenticate(r *http.Request) (*AccessContext, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	hash, ok := p.users[user]
+	if !ok {
+		unknownUserHash.verify(password)
+		return nil, fmt.Errorf("%w: user %s", ErrCredentialInvalid, user)
+	}
+	if !hash.verify(password) {
+		return nil, fmt.Errorf("%w: user %s", ErrCredentialInvalid, user)
+	}
+	return newCredentialAccessContext(p.id, CredentialTypeBasic, user, p.groups[user]), nil
+}
+
+func (p *basicAuthProvider) challenge(header http.Header) {
+	header.Add(echo.HeaderWWWAuthenticate, fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", p.realm))
+}
+
+// readHtpasswd reads the users of a htpasswd file. Only bcrypt and argon2 hashes are accepted.
+func readHtpasswd(path string) (map[string]secretHash, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	users := make(map[string]secretHash)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%w: line %d", ErrCredentialHtpasswd, lineNumber)
+		}
+		parsed, err := parseSecretHash(hash)
+		if err == nil && isSHA256Hash(parsed) {
+			err = ErrCredentialHashUnsupported
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrCredentialHtpasswd, lineNumber, err)
+		}
+		users[user] = parsed
+	}
+	return users, scanner.Err()
+}
+
+// apiKeyProvider checks static API keys sent in a header.
+// The keys are random, so only SHA-256 hashes are accepted. A slow hash would be computed
+// for every key and every request, which lets any client exhaust the CPU and memory.
+type apiKeyProvider struct {
+	id     string
+	header string
+	keys   []apiKey
+}
+
+type apiKey struct {
+	name   string
+	hash   secretHash
+	groups []string
+}
+
+func newAPIKeyProvider(cfg APIKeyProvider) (*apiKeyProvider, error) {
+	header := cfg.Header
+	if header == "" {
+		header = defaultAPIKeyHeader
+	}
+	keys := make([]apiKey, 0, len(cfg.Keys))
+	for _, key := range cfg.Keys {
+		hash, err := parseSecretHash(key.Hash)
+		if err == nil && !isSHA256Hash(hash) {
+			err = ErrCredentialHashUnsupported
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", key.Name, err)
+		}
+		keys = append(keys, apiKey{name: key.Name, hash: hash, groups: key.Groups})
+	}
+	return &apiKeyProvider{id: cfg.Id, header: header, keys: keys}, nil
+}
+
+func (p *apiKeyProvider) authenticate(r *http.Request) (*AccessContext, error) {
+	value := strings.TrimSpace(r.Header.Get(p.header))
+	if value == "" {
+		return nil, nil
+	}
+	for _, key := range p.keys {
+		if key.hash.verify(value) {
+			return newCredentialAccessContext(p.id, CredentialTypeAPIKey, key.name, key.groups), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown API key in header %s", ErrCredentialInvalid, p.header)
+}
+
+// challenge sets no header, there is no registered scheme for API keys.
+func (p *apiKeyProvider) challenge(http.Header) {}
+
+// secretHash is a parsed password or key hash.
+type secretHash interface {
+	verify(secret string) bool
+}
+
+// parseSecretHash parses a bcrypt ("$2y$..."), argon2 ("$argon2id$v=19$m=...,t=...,p=...$salt$key")
+// or SHA-256 ("sha256:<hex>") hash. SHA-256 is only suited for random keys, not for passwords.
+func parseSecretHash(hash string) (secretHash, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCredentialHashInvalid, err)
+		}
+		return bcryptHash(hash), nil
+	case strings.HasPrefix(hash, "$argon2id$"), strings.HasPrefix(hash, "$argon2i$"):
+		parsed, err := parseArgon2Hash(hash)
+		if err != nil {
+			return nil, err
+		}
+		return parsed, nil
+	case strings.HasPrefix(hash, "sha256:"):
+		sum, err := hex.DecodeString(strings.TrimPrefix(hash, "sha256:"))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, ErrCredentialHashInvalid
+		}
+		return sha256Hash(sum), nil
+	}
+	return nil, ErrCredentialHashUnsupported
+}
+
+func isSHA256Hash(hash secretHash) bool {
+	_, ok := hash.(sha256Hash)
+	return ok
+}
+
+type bcryptHash []byte
+
+func (h bcryptHash) verify(secret string) bool {
+	return bcrypt.CompareHashAndPassword(h, []byte(secret)) == nil
+}
+
+type sha256Hash []byte
+
+func (h sha256Hash) verify(secret string) bool {
+	sum := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(h, sum[:]) == 1
+}
+
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2Hash parses the PHC string format of argon2, which is also used by htpasswd tools.
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, ErrCredentialHashInvalid
+	}
+	h := &argon2Hash{variant: parts[1]}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCredentialHashInvalid, err)
+	}
+	// argon2 panics without time or threads
+	if h.time < 1 || h.threads < 1 || h.memory > maxArgon2Memory {
+		return nil, fmt.Errorf("%w: argon2 parameters out of range", ErrCredentialHashInvalid)
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCredentialHashInvalid, err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, ErrCredentialHashInvalid
+	}
+	return h, nil
+}
+
+func (h *argon2Hash) verify(secret string) bool {
+	var key []byte
+	if h.variant == "argon2id" {
+		key = argon2.IDKey([]byte(secret), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		key = argon2.Key([]byte(secret), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(h.key, key) == 1
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func argon2idHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestParseSecretHash(t *testing.T) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{
+		string(bcrypted),
+		argon2idHash("password"),
+		"sha256:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8",
+	} {
+		parsed, err := parseSecretHash(hash)
+		if err != nil {
+			t.Fatalf("can not parse %s: %v", hash, err)
+		}
+		assert.Equal(t, parsed.verify("password"), true)
+		assert.Equal(t, parsed.verify("other"), false)
+	}
+
+	_, err = parseSecretHash("{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=")
+	assert.Equal(t, errors.Is(err, ErrCredentialHashUnsupported), true)
+	_, err = parseSecretHash("$apr1$salt$hash")
+	assert.Equal(t, errors.Is(err, ErrCredentialHashUnsupported), true)
+	_, err = parseSecretHash("sha256:abc")
+	assert.Equal(t, errors.Is(err, ErrCredentialHashInvalid), true)
+	_, err = parseSecretHash("$argon2id$v=19$m=1024$salt$key")
+	assert.Equal(t, errors.Is(err, ErrCredentialHashInvalid), true)
+
+	// parameters, which panic or exhaust the memory, are rejected on load
+	for _, params := range []string{"m=1024,t=0,p=1", "m=1024,t=1,p=0", "m=4194304,t=1,p=1"} {
+		_, err = parseSecretHash("$argon2id$v=19$" + params + "$MDEyMzQ1Njc4OWFiY2RlZg$a2V5")
+		assert.Equal(t, errors.Is(err, ErrCredentialHashInvalid), true)
+	}
+}
+
+func TestReadHtpasswd(t *testing.T) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("bot-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := fmt.Sprintf("# machine accounts\nbot:%s\n\nlegacy:%s\n", bcrypted, argon2idHash("legacy-password"))
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := readHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(users), 2)
+	assert.Equal(t, users["bot"].verify("bot-password"), true)
+	assert.Equal(t, users["legacy"].verify("legacy-password"), true)
+
+	// SHA-256 is not accepted for passwords
+	content = "bot:sha256:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readHtpasswd(path)
+	assert.Equal(t, errors.Is(err, ErrCredentialHtpasswd), true)
+}
+
+func TestCredentialMiddleware(t *testing.T) {
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("bot-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("bot:"+string(bcrypted)+"\nother:"+string(bcrypted)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		Settings: Settings{Session: SettingsSession{Key: "secret"}},
+		Content: ContentConfig{
+			BasicAuth: []BasicAuthProvider{
+				{Id: "legacy", HtpasswdFile: htpasswd, Realm: "Legacy", Groups: map[string][]string{"bot": {"deploy"}}},
+			},
+			APIKeys: []APIKeyProvider{
+				{Id: "keys", Header: "X-Deploy-Key", Keys: []APIKey{
+					{Name: "ci", Hash: "sha256:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", Groups: []string{"deploy"}},
+					{Name: "monitoring", Hash: "sha256:66e4eb9dda9248e88b5937a2fa01655a161b46ac908f58077210b2057c4f5b24"},
+				}},
+			},
+		},
+	}
+	o, err := New(Providers{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := AccessPolicies{}.Compile(&StaticPageProtection{
+		Providers:  []string{"legacy", "keys"},
+		Groups:     []string{"deploy"},
+		Expression: `subject != "blocked"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware, err := o.CreateMiddleware(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := middleware(func(c echo.Context) error {
+		accessContext := c.Get(accessContextKey).(*AccessContext)
+		return c.String(http.StatusOK, accessContext.Provider+":"+accessContext.Subject)
+	})
+
+	tests := []struct {
+		headers        map[string]string
+		basicAuth      []string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{basicAuth: []string{"bot", "bot-password"}, expectedStatus: http.StatusOK, expectedBody: "legacy:bot"},
+		{basicAuth: []string{"bot", "wrong"}, expectedStatus: http.StatusUnauthorized},
+		{basicAuth: []string{"other", "bot-password"}, expectedStatus: http.StatusForbidden},
+		{basicAuth: []string{"unknown", "bot-password"}, expectedStatus: http.StatusUnauthorized},
+		{headers: map[string]string{"X-Deploy-Key": "password"}, expectedStatus: http.StatusOK, expectedBody: "keys:ci"},
+		{headers: map[string]string{"X-Deploy-Key": "monitoring-key"}, expectedStatus: http.StatusForbidden},
+		{headers: map[string]string{"X-Deploy-Key": "wrong"}, expectedStatus: http.StatusUnauthorized},
+		{expectedStatus: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/machines/file.txt", nil)
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		if test.basicAuth != nil {
+			req.SetBasicAuth(test.basicAuth[0], test.basicAuth[1])
+		}
+		rec := httptest.NewRecorder()
+		if err := handler(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, rec.Code, test.expectedStatus)
+		if test.expectedBody != "" {
+			assert.Equal(t, rec.Body.String(), test.expectedBody)
+		}
+		if test.expectedStatus == http.StatusUnauthorized {
+			assert.Equal(t, rec.Header().Get(echo.HeaderWWWAuthenticate), `Basic realm="Legacy", charset="UTF-8"`)
+		}
+	}
+
+	// the ids must be unique
+	cfg.Content.APIKeys[0].Id = "legacy"
+	_, err = New(Providers{}, cfg)
+	assert.Equal(t, errors.Is(err, ErrCredentialDuplicate), true)
+}
+
+func TestAPIKeyHash(t *testing.T) {
+	// slow hashes would be computed for every key on every request
+	for _, hash := range []string{argon2idHash("monitoring-key"), string(unknownUserHash)} {
+		_, err := newAPIKeyProvider(APIKeyProvider{Id: "keys", Keys: []APIKey{{Name: "monitoring", Hash: hash}}})
+		assert.Equal(t, errors.Is(err, ErrCredentialHashUnsupported), true)
+	}
+
+	// unknown basic auth users are checked with a hash of the default cost
+	cost, err := bcrypt.Cost(unknownUserHash)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, cost, bcrypt.DefaultCost)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+var (
+	ErrTokenCipherKey        = errors.New("token cipher key must not be empty")
+	ErrTokenCipherCiphertext = errors.New("token ciphertext is invalid")
+)
+
+// The tokenCipher encrypts tokens before they are stored in the session.
+// It uses AES-256-GCM with a key derived from the session key.
+type tokenCipher struct {
+	aead cipher.AEAD
+}
+
+// newTokenCipher creates a tokenCipher from the given key.
+// The key is hashed with SHA-256 to get a key with the required length.
+func newTokenCipher(key string) (*tokenCipher, error) {
+	if key == "" {
+		return nil, ErrTokenCipherKey
+	}
+	hashed := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(hashed[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenCipher{aead: aead}, nil
+}
+
+// Encrypt encrypts the plaintext and returns it base64 encoded with the nonce as prefix.
+func (t *tokenCipher) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := t.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverts Encrypt.
+// It returns ErrTokenCipherCiphertext if the ciphertext is malformed or was modified.
+func (t *tokenCipher) Decrypt(ciphertext string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(ciphertext)
+	if err != nil || len(sealed) < t.aead.NonceSize() {
+		return "", ErrTokenCipherCiphertext
+	}
+	nonce, data := sealed[:t.aead.NonceSize()], sealed[t.aead.NonceSize():]
+	plaintext, err := t.aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return "", ErrTokenCipherCiphertext
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestTokenCipher(t *testing.T) {
+	c, err := newTokenCipher("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := c.Encrypt("refresh-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, encrypted, "refresh-token")
+
+	decrypted, err := c.Decrypt(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, decrypted, "refresh-token")
+
+	// modified ciphertext
+	_, err = c.Decrypt(encrypted[:len(encrypted)-2] + "AA")
+	assert.Equal(t, errors.Is(err, ErrTokenCipherCiphertext), true)
+
+	// other key
+	other, err := newTokenCipher("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.Decrypt(encrypted)
+	assert.Equal(t, errors.Is(err, ErrTokenCipherCiphertext), true)
+
+	_, err = newTokenCipher("")
+	assert.Equal(t, errors.Is(err, ErrTokenCipherKey), true)
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/d5/tengo/v2"
 	"github.com/d5/tengo/v2/stdlib"
@@ -17,16 +21,46 @@ var (
 	ErrExpressionRun         = errors.New("error running expression script")
 	ErrExpressionResMissing  = errors.New("variable __res__ not found after expression evaluation")
 	ErrExpressionResNotBool  = errors.New("variable __res__ is not a bool after expression evaluation")
+	ErrExpressionTimeout     = errors.New("expression evaluation timed out")
+	ErrExpressionLimit       = errors.New("expression evaluation exceeded a resource limit")
 )
 
+const (
+	defaultExpressionTimeout   = 100 * time.Millisecond
+	defaultExpressionMaxAllocs = 10000
+)
+
+// ExpressionLimits restrict the resources of an expression evaluation.
+type ExpressionLimits struct {
+	// maximum duration of one evaluation
+	Timeout time.Duration
+	// maximum count of allocated objects in one evaluation
+	MaxAllocs int64
+}
+
 // The Expression contains a compiled Tengo script for evaluating expressions.
 type Expression struct {
 	compiled *tengo.Compiled
+	limits   ExpressionLimits
 }
 
-// newExpression creates a new Expression by compiling the given expression string.
+// newExpression creates a new Expression with the default limits by compiling the given expression string.
 // It returns ErrExpressionCompile if the compilation fails.
 func newExpression(expression string) (*Expression, error) {
+	return newExpressionWithLimits(expression, ExpressionLimits{})
+}
+
+// newExpressionWithLimits creates a new Expression by compiling the given expression string.
+// Limits with a zero value are replaced by the defaults.
+// It returns ErrExpressionCompile if the compilation fails.
+func newExpressionWithLimits(expression string, limits ExpressionLimits) (*Expression, error) {
+	if limits.Timeout <= 0 {
+		limits.Timeout = defaultExpressionTimeout
+	}
+	if limits.MaxAllocs <= 0 {
+		limits.MaxAllocs = defaultExpressionMaxAllocs
+	}
+
 	script := tengo.NewScript([]byte(fmt.Sprintf(`
 		math := import("math")
 		text := import("text")
@@ -35,11 +69,18 @@ func newExpression(expression string) (*Expression, error) {
 	`, expression)))
 	// import standard libraries
 	script.SetImports(stdlib.GetModuleMap("math", "text", "times"))
-	// set predefined variables
-	err := script.Add("user", map[string]any{})
-	if err != nil {
-		log.WithError(err).Error(ErrExpressionAddVariable.Error())
-		return nil, ErrExpressionAddVariable
+	script.SetMaxAllocs(limits.MaxAllocs)
+	// set predefined variables and functions
+	variables := (&AccessContext{}).expressionVariables()
+	for name, fn := range expressionFunctions {
+		variables[name] = fn
+	}
+	for name, value := range variables {
+		err := script.Add(name, value)
+		if err != nil {
+			log.WithError(err).Error(ErrExpressionAddVariable.Error())
+			return nil, ErrExpressionAddVariable
+		}
 	}
 	compiled, err := script.Compile()
 	if err != nil {
@@ -48,19 +89,44 @@ func newExpression(expression string) (*Expression, error) {
 	}
 	return &Expression{
 		compiled: compiled,
+		limits:   limits,
 	}, nil
 }
 
 // Eval evaluates the expression against the provided user value map.
 // It returns the boolean result of the evaluation or an error if the evaluation fails.
 func (e *Expression) Eval(value map[string]any) (bool, error) {
+	return e.EvalContext(&AccessContext{UserInfo: value})
+}
+
+// EvalContext evaluates the expression against the access context.
+// The variables user, id_token, groups, subject, provider and expires_at are set from the context.
+// It returns the boolean result of the evaluation or an error if the evaluation fails.
+// When the evaluation exceeds the timeout or another limit, ErrExpressionTimeout or ErrExpressionLimit is returned.
+func (e *Expression) EvalContext(ctx *AccessContext) (bool, error) {
 	cloned := e.compiled.Clone()
-	err := cloned.Set("user", value)
-	if err != nil {
-		log.WithError(err).Error(ErrExpressionSetVariable.Error())
-		return false, ErrExpressionSetVariable
+	for name, value := range ctx.expressionVariables() {
+		err := cloned.Set(name, value)
+		if errors.Is(err, tengo.ErrStringLimit) || errors.Is(err, tengo.ErrBytesLimit) {
+			log.WithError(err).Error(ErrExpressionLimit.Error())
+			return false, ErrExpressionLimit
+		}
+		if err != nil {
+			log.WithError(err).Error(ErrExpressionSetVariable.Error())
+			return false, ErrExpressionSetVariable
+		}
+	}
+	runCtx, cancel := context.WithTimeout(context.Background(), e.limits.Timeout)
+	defer cancel()
+	err := cloned.RunContext(runCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.WithError(err).Error(ErrExpressionTimeout.Error())
+		return false, ErrExpressionTimeout
+	}
+	if errors.Is(err, tengo.ErrObjectAllocLimit) || errors.Is(err, tengo.ErrStringLimit) || errors.Is(err, tengo.ErrBytesLimit) {
+		log.WithError(err).Error(ErrExpressionLimit.Error())
+		return false, ErrExpressionLimit
 	}
-	err = cloned.Run()
 	if err != nil {
 		log.WithError(err).Error(ErrExpressionRun.Error())
 		return false, ErrExpressionRun
@@ -77,3 +143,107 @@ func (e *Expression) Eval(value map[string]any) (bool, error) {
 	}
 	return result, nil
 }
+
+// setExpressionLengthLimits sets the maximum length of strings and bytes in all expressions.
+// Tengo only supports global limits, values <= 0 keep the current limit.
+func setExpressionLengthLimits(maxStringLen, maxBytesLen int) {
+	if maxStringLen > 0 {
+		tengo.MaxStringLen = maxStringLen
+	}
+	if maxBytesLen > 0 {
+		tengo.MaxBytesLen = maxBytesLen
+	}
+}
+
+// expressionFunctions are the additional functions for the expressions
+var expressionFunctions = map[string]*tengo.UserFunction{
+	"contains":   {Name: "contains", Value: expressionContains},
+	"cidr_match": {Name: "cidr_match", Value: expressionCIDRMatch},
+	"glob_match": {Name: "glob_match", Value: expressionGlobMatch},
+}
+
+// expressionContains implements contains(collection, value).
+// It checks if an array contains the value, a map contains the key or a string contains the substring.
+func expressionContains(args ...tengo.Object) (tengo.Object, error) {
+	if len(args) != 2 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	switch collection := args[0].(type) {
+	case *tengo.Array:
+		for _, item := range collection.Value {
+			if item.Equals(args[1]) {
+				return tengo.TrueValue, nil
+			}
+		}
+	case *tengo.ImmutableArray:
+		for _, item := range collection.Value {
+			if item.Equals(args[1]) {
+				return tengo.TrueValue, nil
+			}
+		}
+	case *tengo.Map, *tengo.ImmutableMap, *tengo.String:
+		key, ok := tengo.ToString(args[1])
+		if !ok {
+			return nil, tengo.ErrInvalidArgumentType{Name: "second", Expected: "string", Found: args[1].TypeName()}
+		}
+		switch c := collection.(type) {
+		case *tengo.Map:
+			_, found := c.Value[key]
+			return boolObject(found), nil
+		case *tengo.ImmutableMap:
+			_, found := c.Value[key]
+			return boolObject(found), nil
+		case *tengo.String:
+			return boolObject(strings.Contains(c.Value, key)), nil
+		}
+	case *tengo.Undefined:
+	default:
+		return nil, tengo.ErrInvalidArgumentType{Name: "first", Expected: "array, map or string", Found: args[0].TypeName()}
+	}
+	return tengo.FalseValue, nil
+}
+
+// expressionCIDRMatch implements cidr_match(ip, cidr...).
+// It checks if the IP is part of at least one of the CIDRs.
+func expressionCIDRMatch(args ...tengo.Object) (tengo.Object, error) {
+	if len(args) < 2 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	values := make([]string, len(args))
+	for i, arg := range args {
+		value, ok := tengo.ToString(arg)
+		if !ok {
+			return nil, tengo.ErrInvalidArgumentType{Name: fmt.Sprintf("argument %d", i+1), Expected: "string", Found: arg.TypeName()}
+		}
+		values[i] = value
+	}
+	cidrs, err := parseCIDRs(values[1:])
+	if err != nil {
+		return nil, err
+	}
+	return boolObject(ipInCIDRs(net.ParseIP(values[0]), cidrs)), nil
+}
+
+// expressionGlobMatch implements glob_match(pattern, value).
+func expressionGlobMatch(args ...tengo.Object) (tengo.Object, error) {
+	if len(args) != 2 {
+		return nil, tengo.ErrWrongNumArguments
+	}
+	pattern, ok := tengo.ToString(args[0])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{Name: "pattern", Expected: "string", Found: args[0].TypeName()}
+	}
+	value, ok := tengo.ToString(args[1])
+	if !ok {
+		return nil, tengo.ErrInvalidArgumentType{Name: "value", Expected: "string", Found: args[1].TypeName()}
+	}
+	return boolObject(globMatch(pattern, value)), nil
+}
+
+// boolObject converts the bool into the tengo object.
+func boolObject(b bool) tengo.Object {
+	if b {
+		return tengo.TrueValue
+	}
+	return tengo.FalseValue
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"errors"
 	"testing"
+	"time"
+
+	"github.com/d5/tengo/v2"
 )
 
 func TestExpression(t *testing.T) {
@@ -82,3 +85,159 @@ func TestExpressionWrongSyntax(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestExpressionContext(t *testing.T) {
+	ctx := &AccessContext{
+		Provider:  "entra",
+		Subject:   "1234",
+		Groups:    []string{"staff", "admins"},
+		UserInfo:  map[string]any{"email": "jane@example.com", "name": "from-userinfo"},
+		IDToken:   map[string]any{"acr": "mfa", "name": "from-id-token", "amr": []any{"pwd", "otp"}},
+		ExpiresAt: 1700000000,
+	}
+
+	tests := []struct {
+		expression string
+		expected   bool
+	}{
+		{`contains(groups, "admins") && id_token.acr == "mfa"`, true},
+		{`contains(groups, "finance")`, false},
+		{`contains(id_token.amr, "otp")`, true},
+		{`contains(user, "email") && !contains(user, "phone")`, true},
+		{`contains(user.email, "@example.com")`, true},
+		{`provider == "entra" && subject == "1234"`, true},
+		{`expires_at == 1700000000`, true},
+		// user info wins over id token claims
+		{`user.name == "from-userinfo"`, true},
+		{`user.acr == "mfa"`, true},
+		{`contains(user.missing, "x")`, false},
+	}
+
+	for _, test := range tests {
+		e, err := newExpression(test.expression)
+		if err != nil {
+			t.Errorf("failed to create expression %q: %v", test.expression, err)
+			continue
+		}
+		result, err := e.EvalContext(ctx)
+		if err != nil {
+			t.Errorf("failed to evaluate expression %q: %v", test.expression, err)
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("unexpected result for expression %q: got %v, want %v", test.expression, result, test.expected)
+		}
+	}
+}
+
+func TestExpressionRequest(t *testing.T) {
+	ctx := &AccessContext{
+		Request: &RequestInfo{
+			Method:  "GET",
+			Host:    "docs.example.com",
+			Path:    "/page/internal/report.pdf",
+			Query:   map[string]string{"version": "2"},
+			Headers: map[string]string{"user-agent": "curl/8.0"},
+			IP:      "10.1.2.3",
+		},
+	}
+
+	tests := []struct {
+		expression string
+		expected   bool
+	}{
+		{`request.method == "GET" && request.query.version == "2"`, true},
+		{`request.headers["user-agent"] == "curl/8.0"`, true},
+		{`cidr_match(request.ip, "192.168.0.0/16", "10.0.0.0/8")`, true},
+		{`cidr_match(request.ip, "192.168.0.0/16")`, false},
+		{`glob_match("/page/internal/**", request.path)`, true},
+		{`glob_match("*.example.com", request.host)`, true},
+		{`!glob_match("/page/*", request.path) || request.method != "DELETE"`, true},
+	}
+
+	for _, test := range tests {
+		e, err := newExpression(test.expression)
+		if err != nil {
+			t.Errorf("failed to create expression %q: %v", test.expression, err)
+			continue
+		}
+		result, err := e.EvalContext(ctx)
+		if err != nil {
+			t.Errorf("failed to evaluate expression %q: %v", test.expression, err)
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("unexpected result for expression %q: got %v, want %v", test.expression, result, test.expected)
+		}
+	}
+
+	// invalid CIDR
+	e, err := newExpression(`cidr_match(request.ip, "invalid")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.EvalContext(ctx)
+	if !errors.Is(err, ErrExpressionRun) {
+		t.Errorf("unexpected error: got %v, want %v", err, ErrExpressionRun)
+	}
+}
+
+func TestExpressionLimits(t *testing.T) {
+	test := []struct {
+		expression  string
+		limits      ExpressionLimits
+		expectedErr error
+	}{
+		// infinite loop
+		{
+			expression:  `func() { for { } ; return true }()`,
+			limits:      ExpressionLimits{Timeout: 50 * time.Millisecond},
+			expectedErr: ErrExpressionTimeout,
+		},
+		// too many allocations
+		{
+			expression:  `func() { a := []; for i := 0; i < 1000; i++ { a = append(a, i) }; return true }()`,
+			limits:      ExpressionLimits{MaxAllocs: 100},
+			expectedErr: ErrExpressionLimit,
+		},
+		// within the limits
+		{
+			expression:  `func() { a := []; for i := 0; i < 10; i++ { a = append(a, i) }; return len(a) == 10 }()`,
+			limits:      ExpressionLimits{MaxAllocs: 100},
+			expectedErr: nil,
+		},
+	}
+
+	for _, testCase := range test {
+		e, err := newExpressionWithLimits(testCase.expression, testCase.limits)
+		if err != nil {
+			t.Errorf("failed to create expression %q: %v", testCase.expression, err)
+			continue
+		}
+		_, err = e.EvalContext(&AccessContext{})
+		if !errors.Is(err, testCase.expectedErr) {
+			t.Errorf("unexpected error for expression %q: got %v, want %v", testCase.expression, err, testCase.expectedErr)
+		}
+	}
+}
+
+func TestExpressionLengthLimits(t *testing.T) {
+	maxStringLen := tengo.MaxStringLen
+	defer func() {
+		tengo.MaxStringLen = maxStringLen
+	}()
+	setExpressionLengthLimits(10, 0)
+
+	e, err := newExpression(`user.name + user.name == ""`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Eval(map[string]any{"name": "12345678"})
+	if !errors.Is(err, ErrExpressionLimit) {
+		t.Errorf("unexpected error: got %v, want %v", err, ErrExpressionLimit)
+	}
+	_, err = e.Eval(map[string]any{"name": "12345678901"})
+	if !errors.Is(err, ErrExpressionLimit) {
+		t.Errorf("unexpected error: got %v, want %v", err, ErrExpressionLimit)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HeaderAuthRequestUser              = "X-Auth-Request-User"
+	HeaderAuthRequestPreferredUsername = "X-Auth-Request-Preferred-Username"
+	HeaderAuthRequestEmail             = "X-Auth-Request-Email"
+	HeaderAuthRequestGroups            = "X-Auth-Request-Groups"
+	HeaderAuthRequestLoginUrl          = "X-Auth-Request-Login-Url"
+)
+
+// keys of the echo context
+const (
+	// the AccessContext of the user, set by the protection middleware when access is granted
+	accessContextKey = "access_context"
+	// the original url of a forward auth request
+	forwardedURLKey = "forwarded_url"
+)
+
+// createVerifyHandler creates the forward auth handler for nginx auth_request and Traefik ForwardAuth.
+// It evaluates the protection of the page or the named policy of the query parameters for the forwarded request.
+// The forwarded request is read from the X-Forwarded-* headers (or X-Original-URL).
+// On success, it answers with 200 and the user in the X-Auth-Request-* headers,
+// otherwise with 401 and the login url or 403.
+func (w *Webserver) createVerifyHandler() echo.HandlerFunc {
+	granted := func(c echo.Context) error {
+		if accessContext, ok := c.Get(accessContextKey).(*AccessContext); ok {
+			setAuthRequestHeaders(c.Response().Header(), accessContext)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+
+	return func(c echo.Context) error {
+		var protector echo.MiddlewareFunc
+		if pageId := c.QueryParam("page"); pageId != "" {
+			var ok bool
+			if protector, ok = w.pageProtectors[pageId]; !ok {
+				return c.String(http.StatusNotFound, "unknown page")
+			}
+		} else if policyId := c.QueryParam("policy"); policyId != "" {
+			var ok bool
+			if protector, ok = w.policyProtectors[policyId]; !ok {
+				return c.String(http.StatusNotFound, "unknown policy")
+			}
+		} else {
+			return c.String(http.StatusBadRequest, "page or policy parameter missing")
+		}
+
+		forwarded, forwardedURL := forwardedRequest(c.Request())
+		c.SetRequest(forwarded)
+		c.Set(forwardedURLKey, forwardedURL)
+
+		// pages without protection are public
+		if protector == nil {
+			return granted(c)
+		}
+		return protector(granted)(c)
+	}
+}
+
+// createPolicyProtectors creates the protection middlewares for all named policies with providers.
+// Policies without providers can only be referenced by other policies.
+func (w *Webserver) createPolicyProtectors() error {
+	w.policyProtectors = make(map[string]echo.MiddlewareFunc)
+	for id, policy := range w.policies {
+		if len(policy.Providers()) == 0 {
+			continue
+		}
+		protector, err := w.oidc.CreateMiddleware(policy)
+		if err != nil {
+			log.WithField("policy", id).WithError(err).Error("Error creating protection middleware")
+			return err
+		}
+		w.policyProtectors[id] = protector
+	}
+	return nil
+}
+
+// forwardedRequest creates the original request of a forward auth request and returns its absolute url.
+// The url is read from X-Original-URL (nginx) or from X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Uri (Traefik),
+// the method from X-Forwarded-Method or X-Original-Method and defaults to GET.
+// Cookies and all other headers of the forward auth request are kept.
+func forwardedRequest(r *http.Request) (*http.Request, string) {
+	forwarded := r.Clone(r.Context())
+
+	u, err := url.Parse(r.Header.Get("X-Original-URL"))
+	if err != nil || r.Header.Get("X-Original-URL") == "" {
+		u = &url.URL{
+			Scheme: firstHeader(r, "X-Forwarded-Proto"),
+			Host:   firstHeader(r, "X-Forwarded-Host"),
+		}
+		if u.Scheme == "" {
+			u.Scheme = "http"
+		}
+		if u.Host == "" {
+			u.Host = r.Host
+		}
+		uri, err := url.ParseRequestURI(r.Header.Get("X-Forwarded-Uri"))
+		if err == nil {
+			u.Path, u.RawPath, u.RawQuery = uri.Path, uri.RawPath, uri.RawQuery
+		} else {
+			u.Path = "/"
+		}
+	}
+
+	forwarded.Method = http.MethodGet
+	for _, header := range []string{"X-Forwarded-Method", "X-Original-Method"} {
+		if method := r.Header.Get(header); method != "" {
+			forwarded.Method = strings.ToUpper(method)
+			break
+		}
+	}
+	forwarded.Host = u.Host
+	forwarded.URL = &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	forwarded.RequestURI = forwarded.URL.RequestURI()
+	return forwarded, u.String()
+}
+
+// firstHeader returns the first value of a comma separated header, which can be added by multiple proxies.
+func firstHeader(r *http.Request, name string) string {
+	value, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// setAuthRequestHeaders sets the X-Auth-Request-* headers for the user.
+func setAuthRequestHeaders(header http.Header, accessContext *AccessContext) {
+	user := accessContext.User()
+	header.Set(HeaderAuthRequestUser, accessContext.Subject)
+	if username, ok := user["preferred_username"].(string); ok && username != "" {
+		header.Set(HeaderAuthRequestPreferredUsername, username)
+	}
+	if email, ok := user["email"].(string); ok && email != "" {
+		header.Set(HeaderAuthRequestEmail, email)
+	}
+	if len(accessContext.Groups) > 0 {
+		header.Set(HeaderAuthRequestGroups, strings.Join(accessContext.Groups, ","))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedRequest(t *testing.T) {
+	tests := []struct {
+		headers        map[string]string
+		expectedURL    string
+		expectedMethod string
+		expectedPath   string
+	}{
+		{
+			headers: map[string]string{
+				"X-Forwarded-Proto":  "https",
+				"X-Forwarded-Host":   "app.example.com",
+				"X-Forwarded-Uri":    "/docs/a%20b?x=1",
+				"X-Forwarded-Method": "post",
+			},
+			expectedURL:    "https://app.example.com/docs/a%20b?x=1",
+			expectedMethod: http.MethodPost,
+			expectedPath:   "/docs/a b",
+		},
+		{
+			headers: map[string]string{
+				"X-Original-URL":    "https://app.example.com/reports?year=2024",
+				"X-Original-Method": "GET",
+			},
+			expectedURL:    "https://app.example.com/reports?year=2024",
+			expectedMethod: http.MethodGet,
+			expectedPath:   "/reports",
+		},
+		{
+			// multiple proxies and no uri
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https, http",
+				"X-Forwarded-Host":  "app.example.com, proxy.local",
+			},
+			expectedURL:    "https://app.example.com/",
+			expectedMethod: http.MethodGet,
+			expectedPath:   "/",
+		},
+		{
+			// no headers at all
+			headers:        nil,
+			expectedURL:    "http://auth.example.com/",
+			expectedMethod: http.MethodGet,
+			expectedPath:   "/",
+		},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://auth.example.com/auth/verify?page=docs", nil)
+		req.AddCookie(&http.Cookie{Name: sessionName, Value: "session"})
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		forwarded, forwardedURL := forwardedRequest(req)
+		if forwardedURL != test.expectedURL {
+			t.Errorf("unexpected url: got %s, want %s", forwardedURL, test.expectedURL)
+		}
+		if forwarded.Method != test.expectedMethod || forwarded.URL.Path != test.expectedPath {
+			t.Errorf("unexpected request: got %s %s, want %s %s", forwarded.Method, forwarded.URL.Path, test.expectedMethod, test.expectedPath)
+		}
+		if _, err := forwarded.Cookie(sessionName); err != nil {
+			t.Errorf("expected the session cookie to be kept")
+		}
+	}
+}
+
+func TestSetAuthRequestHeaders(t *testing.T) {
+	header := http.Header{}
+	setAuthRequestHeaders(header, &AccessContext{
+		Subject:  "1",
+		Groups:   []string{"staff", "/org/team-a"},
+		IDToken:  map[string]any{"email": "alice@example.com"},
+		UserInfo: map[string]any{"preferred_username": "alice"},
+	})
+	expected := map[string]string{
+		HeaderAuthRequestUser:              "1",
+		HeaderAuthRequestPreferredUsername: "alice",
+		HeaderAuthRequestEmail:             "alice@example.com",
+		HeaderAuthRequestGroups:            "staff,/org/team-a",
+	}
+	for name, value := range expected {
+		if header.Get(name) != value {
+			t.Errorf("unexpected header %s: got %q, want %q", name, header.Get(name), value)
+		}
+	}
+}
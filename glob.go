@@ -0,0 +1,39 @@
+package main
+
+// globMatch reports whether the value matches the glob pattern.
+// A "**" matches any sequence of characters, a "*" any sequence without "/"
+// and a "?" one character except "/".
+// All other characters must match exactly.
+func globMatch(pattern, value string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			anySlash := len(pattern) > 1 && pattern[1] == '*'
+			rest := pattern[1:]
+			if anySlash {
+				rest = pattern[2:]
+			}
+			// try all possible lengths for the star
+			for i := 0; i <= len(value); i++ {
+				if globMatch(rest, value[i:]) {
+					return true
+				}
+				if i < len(value) && value[i] == '/' && !anySlash {
+					return false
+				}
+			}
+			return false
+		case '?':
+			if len(value) == 0 || value[0] == '/' {
+				return false
+			}
+		default:
+			if len(value) == 0 || value[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		value = value[1:]
+	}
+	return len(value) == 0
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		value    string
+		expected bool
+	}{
+		{"/assets/*", "/assets/logo.png", true},
+		{"/assets/*", "/assets/img/logo.png", false},
+		{"/assets/**", "/assets/img/logo.png", true},
+		{"/assets/**", "/assets/", true},
+		{"/**/*.pdf", "/finance/2024/report.pdf", true},
+		{"/**/*.pdf", "/finance/2024/report.txt", false},
+		{"*.example.com", "docs.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"/file?.txt", "/file1.txt", true},
+		{"/file?.txt", "/file/.txt", false},
+		{"/exact", "/exact", true},
+		{"/exact", "/exact/", false},
+		{"", "", true},
+		{"**", "/anything/at/all", true},
+	}
+	for _, test := range tests {
+		if result := globMatch(test.pattern, test.value); result != test.expected {
+			t.Errorf("unexpected result for pattern %q and value %q: got %v, want %v", test.pattern, test.value, result, test.expected)
+		}
+	}
+}
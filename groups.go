@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var ErrGroupPatternInvalid = errors.New("group pattern is invalid")
+
+// prefix of group patterns, which are regular expressions
+const groupRegexPrefix = "regex:"
+
+// groupPattern matches group names exactly, with a glob or with a regular expression.
+type groupPattern struct {
+	value string
+	glob  bool
+	regex *regexp.Regexp
+}
+
+// parseGroupPattern parses a group pattern.
+// Patterns with the prefix "regex:" are regular expressions, which must match the whole group name.
+// Patterns with "*" or "?" are globs, all other patterns must match exactly.
+func parseGroupPattern(pattern string) (groupPattern, error) {
+	if expr, ok := strings.CutPrefix(pattern, groupRegexPrefix); ok {
+		regex, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return groupPattern{}, fmt.Errorf("%w: %q: %v", ErrGroupPatternInvalid, pattern, err)
+		}
+		return groupPattern{value: pattern, regex: regex}, nil
+	}
+	if pattern == "" {
+		return groupPattern{}, fmt.Errorf("%w: empty pattern", ErrGroupPatternInvalid)
+	}
+	return groupPattern{value: pattern, glob: strings.ContainsAny(pattern, "*?")}, nil
+}
+
+// matches checks if the group matches the pattern.
+func (p groupPattern) matches(group string) bool {
+	switch {
+	case p.regex != nil:
+		return p.regex.MatchString(group)
+	case p.glob:
+		return globMatch(p.value, group)
+	default:
+		return p.value == group
+	}
+}
+
+// matchesAny checks if one of the groups matches the pattern.
+func (p groupPattern) matchesAny(groups []string) bool {
+	for _, group := range groups {
+		if p.matches(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupRule checks the groups of a user against the allowed and denied group patterns.
+type groupRule struct {
+	allow []groupPattern
+	deny  []groupPattern
+	// all allow patterns must match instead of one
+	requireAll bool
+}
+
+// newGroupRule parses the allowed and denied group patterns.
+func newGroupRule(allow, deny []string, requireAll bool) (groupRule, error) {
+	rule := groupRule{requireAll: requireAll}
+	for _, pattern := range allow {
+		p, err := parseGroupPattern(pattern)
+		if err != nil {
+			return groupRule{}, err
+		}
+		rule.allow = append(rule.allow, p)
+	}
+	for _, pattern := range deny {
+		p, err := parseGroupPattern(pattern)
+		if err != nil {
+			return groupRule{}, err
+		}
+		rule.deny = append(rule.deny, p)
+	}
+	return rule, nil
+}
+
+// check reports if the groups fulfill the rule.
+// A group matching one of the deny patterns always denies access.
+// Without allow patterns, all other users are allowed.
+func (r groupRule) check(groups []string) bool {
+	for _, p := range r.deny {
+		if p.matchesAny(groups) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, p := range r.allow {
+		matched := p.matchesAny(groups)
+		if r.requireAll && !matched {
+			return false
+		}
+		if !r.requireAll && matched {
+			return true
+		}
+	}
+	return r.requireAll
+}
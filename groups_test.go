@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGroupPattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		group    string
+		expected bool
+	}{
+		{"/org/team-a", "/org/team-a", true},
+		{"/org/team-a", "/org/team-b", false},
+		{"cn=ops,ou=groups", "cn=ops,ou=groups", true},
+		{"/org/*", "/org/team-a", true},
+		{"/org/*", "/org/team-a/sub", false},
+		{"/org/**", "/org/team-a/sub", true},
+		{"team-?", "team-a", true},
+		{"regex:cn=(ops|dev),ou=groups", "cn=dev,ou=groups", true},
+		{"regex:cn=(ops|dev),ou=groups", "cn=dev,ou=groups,dc=example", false},
+		{"regex:team-\\d+", "team-42", true},
+	}
+	for _, test := range tests {
+		p, err := parseGroupPattern(test.pattern)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", test.pattern, err)
+		}
+		if p.matches(test.group) != test.expected {
+			t.Errorf("unexpected result for %s with %s: want %v", test.pattern, test.group, test.expected)
+		}
+	}
+
+	for _, pattern := range []string{"", "regex:team-("} {
+		if _, err := parseGroupPattern(pattern); !errors.Is(err, ErrGroupPatternInvalid) {
+			t.Errorf("expected error %v for %q, got %v", ErrGroupPatternInvalid, pattern, err)
+		}
+	}
+}
+
+func TestGroupRule(t *testing.T) {
+	tests := []struct {
+		allow      []string
+		deny       []string
+		requireAll bool
+		groups     []string
+		expected   bool
+	}{
+		{nil, nil, false, nil, true},
+		{[]string{"staff"}, nil, false, []string{"staff", "ops"}, true},
+		{[]string{"staff"}, nil, false, []string{"ops"}, false},
+		{[]string{"staff", "/org/*"}, nil, false, []string{"/org/team-a"}, true},
+		{[]string{"staff", "/org/*"}, nil, true, []string{"/org/team-a"}, false},
+		{[]string{"staff", "/org/*"}, nil, true, []string{"staff", "/org/team-a"}, true},
+		{nil, []string{"contractors"}, false, []string{"staff", "contractors"}, false},
+		{nil, []string{"contractors"}, false, []string{"staff"}, true},
+		{[]string{"staff"}, []string{"regex:.*-suspended"}, false, []string{"staff", "vpn-suspended"}, false},
+		{[]string{"staff"}, []string{"regex:.*-suspended"}, true, []string{"staff"}, true},
+	}
+	for _, test := range tests {
+		rule, err := newGroupRule(test.allow, test.deny, test.requireAll)
+		if err != nil {
+			t.Fatalf("failed to create group rule: %v", err)
+		}
+		if rule.check(test.groups) != test.expected {
+			t.Errorf("unexpected result for allow=%v deny=%v requireAll=%v with %v: want %v",
+				test.allow, test.deny, test.requireAll, test.groups, test.expected)
+		}
+	}
+}
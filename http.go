@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"strings"
 
@@ -11,6 +14,7 @@ import (
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 
 	log "github.com/sirupsen/logrus"
@@ -20,6 +24,18 @@ type Webserver struct {
 	e    *echo.Echo
 	cfg  *Config
 	oidc *OIDC
+	// compiled named policies, shared by all pages
+	policies AccessPolicies
+	// protection middlewares for the forward auth, nil for public pages
+	pageProtectors   map[string]echo.MiddlewareFunc
+	policyProtectors map[string]echo.MiddlewareFunc
+	// pages with enabled token endpoint
+	tokenPages map[string]tokenPage
+	// signer, store and pages of the share links
+	shareLinks *shareLinks
+
+	// proxies, which are trusted to send the client IP
+	trustedProxies []*net.IPNet
 
 	fsStore    *sessions.FilesystemStore
 	redisStore *redistore.RediStore
@@ -35,12 +51,35 @@ func NewWebserver(cfg *Config, oidc *OIDC) (*Webserver, error) {
 		oidc: oidc,
 	}
 
+	// only trust the client IP headers of the trusted proxies
+	trustedProxies, err := parseCIDRs(cfg.Settings.TrustedProxies)
+	if err != nil {
+		log.WithError(err).Error("Invalid trusted proxies")
+		return nil, err
+	}
+	ws.e.IPExtractor, err = newIPExtractor(trustedProxies, cfg.Settings.ClientIPHeader)
+	if err != nil {
+		log.WithError(err).Error("Invalid client IP header")
+		return nil, err
+	}
+	if cfg.Settings.ProxyProtocol && len(trustedProxies) == 0 {
+		log.WithError(ErrProxyProtocolUntrusted).Error("Invalid PROXY protocol settings")
+		return nil, ErrProxyProtocolUntrusted
+	}
+	ws.trustedProxies = trustedProxies
+
+	err = checkClientAuth(cfg)
+	if err != nil {
+		log.WithError(err).Error("Invalid TLS client auth settings")
+		return nil, err
+	}
+
 	// when TLS and http redirection is enabled, register the redirect handler
 	if tls := cfg.Settings.TLS; tls.Enabled && tls.HTTPRedirect {
 		ws.e.Pre(middleware.HTTPSRedirect())
 	}
 
-	err := ws.createSessionStore()
+	err = ws.createSessionStore()
 	if err != nil {
 		log.WithError(err).Error("Error creating session store")
 		return nil, err
@@ -55,11 +94,38 @@ func NewWebserver(cfg *Config, oidc *OIDC) (*Webserver, error) {
 	}
 	ws.e.Use(session.Middleware(store))
 
+	ws.shareLinks, err = ws.createShareLinks()
+	if err != nil {
+		log.WithError(err).Error("Error creating share links")
+		return nil, err
+	}
+
 	// setup webserver routes
 	ws.e.GET("/auth/:provider/callback", oidc.CreateCallbackHandler())
+	// response_mode=form_post
+	ws.e.POST("/auth/:provider/callback", oidc.CreateCallbackHandler())
 	log.Debug("OIDC Auth Callback handler registered")
+	ws.e.GET("/auth/login", oidc.CreateSelectProviderHandler())
+	ws.e.GET("/auth/:provider/login", oidc.CreateLoginHandler())
+	log.Debug("OIDC Login handler registered")
+	ws.e.GET("/auth/logout", oidc.CreateLogoutHandler())
+	ws.e.GET("/auth/:provider/logout", oidc.CreateLogoutHandler())
+	log.Debug("OIDC Logout handler registered")
+
+	// compile all named policies once
+	ws.policies, err = compilePolicies(cfg.Content.Policies)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("%d access policies compiled", len(ws.policies))
+	err = ws.createPolicyProtectors()
+	if err != nil {
+		return nil, err
+	}
 
 	// register all pages
+	ws.pageProtectors = make(map[string]echo.MiddlewareFunc)
+	ws.tokenPages = make(map[string]tokenPage)
 	for _, page := range cfg.Content.StaticPages {
 		_, err := ws.createStaticPage(ws.e, page)
 		if err != nil {
@@ -67,6 +133,16 @@ func NewWebserver(cfg *Config, oidc *OIDC) (*Webserver, error) {
 		}
 	}
 
+	// forward auth for reverse proxies, nginx uses the method of the original request
+	ws.e.Any("/auth/verify", ws.createVerifyHandler())
+	log.Debug("Forward auth handler registered")
+	ws.e.GET("/auth/:provider/token", ws.createTokenHandler())
+	ws.e.POST("/auth/:provider/token", ws.createTokenHandler())
+	log.Debug("Token handler registered")
+	ws.e.POST("/auth/share", ws.createShareLinkHandler())
+	ws.e.POST("/auth/share/revoke", ws.createShareLinkRevokeHandler())
+	log.Debug("Share link handler registered")
+
 	// hide some stuff
 	ws.e.HideBanner = true
 	ws.e.HidePort = true
@@ -79,45 +155,56 @@ func NewWebserver(cfg *Config, oidc *OIDC) (*Webserver, error) {
 // Also, it will use TLS with certs or Auto-TLS if configured in the settings.
 func (w *Webserver) Start() error {
 	address := w.cfg.Settings.GetWSAddress()
-	tls := w.cfg.Settings.TLS
+	tlsSettings := w.cfg.Settings.TLS
+
+	listener, err := w.listen(address)
+	if err != nil {
+		log.WithError(err).Error("Error starting server")
+		return err
+	}
 
 	// cleartext HTTP2 server (H2C)
-	if !tls.Enabled {
+	if !tlsSettings.Enabled {
 		s := w.cfg.Settings.HTTP2.GetHttps2Server()
+		w.e.Listener = listener
 		return w.e.StartH2CServer(address, s)
 	}
 
 	// TLS HTTP2 server (H2) with predefined certs
 	// when TLS is enabled but AutoTLS is disabled
-	if !tls.AutoTLS {
+	if !tlsSettings.AutoTLS {
 		// check if cert and key files are present
-		if tls.CertFile == "" || tls.KeyFile == "" {
+		if tlsSettings.CertFile == "" || tlsSettings.KeyFile == "" {
 			err := errors.New("TLS is enabled but cert or key file is not set")
 			log.WithError(err).Error("Error starting server")
-			return err
+			return errors.Join(err, listener.Close())
 		} else {
-			if _, err := os.Stat(tls.CertFile); os.IsNotExist(err) {
-				log.WithError(err).Errorf("TLS cert file %s does not exist", tls.CertFile)
-				return err
+			if _, err := os.Stat(tlsSettings.CertFile); os.IsNotExist(err) {
+				log.WithError(err).Errorf("TLS cert file %s does not exist", tlsSettings.CertFile)
+				return errors.Join(err, listener.Close())
 			}
-			if _, err := os.Stat(tls.KeyFile); os.IsNotExist(err) {
-				log.WithError(err).Errorf("TLS key file %s does not exist", tls.KeyFile)
-				return err
+			if _, err := os.Stat(tlsSettings.KeyFile); os.IsNotExist(err) {
+				log.WithError(err).Errorf("TLS key file %s does not exist", tlsSettings.KeyFile)
+				return errors.Join(err, listener.Close())
 			}
 		}
 
-		cert, key := tls.CertFile, tls.KeyFile
-		return w.e.StartTLS(address, cert, key)
+		cert, err := tls.LoadX509KeyPair(tlsSettings.CertFile, tlsSettings.KeyFile)
+		if err != nil {
+			log.WithError(err).Error("Error loading TLS cert")
+			return errors.Join(err, listener.Close())
+		}
+		return w.serveTLS(listener, address, &tls.Config{Certificates: []tls.Certificate{cert}})
 	}
 
 	// TLS HTTP2 server (H2) with AutoTLS
-	cacheDir := tls.AutoTLSCertCacheDir
+	cacheDir := tlsSettings.AutoTLSCertCacheDir
 	// when no cache dir is set, create a tmp dir
 	if cacheDir == "" {
 		tmpDir, err := os.MkdirTemp("", "oauth-static-webserver-autotls")
 		if err != nil {
 			log.WithError(err).Error("Error creating temp dir for AutoTLS cert cache")
-			return err
+			return errors.Join(err, listener.Close())
 		}
 		w.tmpDir = tmpDir
 		cacheDir = tmpDir
@@ -127,7 +214,37 @@ func (w *Webserver) Start() error {
 	w.e.AutoTLSManager.Cache = cache
 
 	log.Infof("Listening on %s", address)
-	return w.e.StartAutoTLS(address)
+	return w.serveTLS(listener, address, &tls.Config{
+		GetCertificate: w.e.AutoTLSManager.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	})
+}
+
+// listen opens the TCP listener of the server.
+// With the PROXY protocol, the listener reads the client address from the header of the trusted proxies.
+func (w *Webserver) listen(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if w.cfg.Settings.ProxyProtocol {
+		return newProxyProtocolListener(listener, w.trustedProxies), nil
+	}
+	return listener, nil
+}
+
+// serveTLS serves HTTPS with HTTP2 on the listener.
+func (w *Webserver) serveTLS(listener net.Listener, address string, tlsConfig *tls.Config) error {
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, "h2", "http/1.1")
+	if err := applyClientAuth(tlsConfig, w.cfg.Settings.TLS); err != nil {
+		log.WithError(err).Error("Error loading TLS client auth")
+		return err
+	}
+	s := w.e.TLSServer
+	s.Addr = address
+	s.TLSConfig = tlsConfig
+	w.e.TLSListener = tls.NewListener(listener, tlsConfig)
+	return w.e.StartServer(s)
 }
 
 // StartAsync the webserver in a new goroutine and provide a close function.
@@ -169,6 +286,13 @@ func (w *Webserver) getStore() (sessions.Store, error) {
 // createSessionStore build the session store from config and set it into the object.
 func (w *Webserver) createSessionStore() error {
 	cfg := &w.cfg.Settings.Session
+	sameSite, err := cfg.GetSameSite()
+	if err != nil {
+		log.WithError(err).Error("Error creating session store")
+		return err
+	}
+	// SameSite=None is only accepted by browsers for secure cookies
+	secure := sameSite == http.SameSiteNoneMode
 	if cfg.StoreDriver == "redis" {
 		store, err := redistore.NewRediStore(
 			cfg.Redis.PoolSize, "tcp",
@@ -181,6 +305,10 @@ func (w *Webserver) createSessionStore() error {
 			return err
 		}
 		store.Options.MaxAge = 60 * 60 * 24 // 1 day
+		store.Options.SameSite = sameSite
+		store.Options.Secure = secure
+		store.Options.Domain = cfg.CookieDomain
+		store.SetMaxLength(sessionMaxLength)
 		w.redisStore = store
 		return nil
 	} else if cfg.StoreDriver == "filesystem" {
@@ -193,6 +321,10 @@ func (w *Webserver) createSessionStore() error {
 		key := []byte(cfg.Key)
 		store := sessions.NewFilesystemStore(cfg.StoreDirectory, key)
 		store.Options.MaxAge = 60 * 60 * 24 // 1 day
+		store.Options.SameSite = sameSite
+		store.Options.Secure = secure
+		store.Options.Domain = cfg.CookieDomain
+		store.MaxLength(sessionMaxLength)
 		w.fsStore = store
 		return nil
 	}
@@ -215,22 +347,135 @@ func (w *Webserver) createStaticPage(e *echo.Echo, config StaticPage) (*echo.Gro
 	group := e.Group(baseContentUrl)
 
 	// attach protection if configured
-	protection := config.Protection
-	if protection != nil {
-		log.WithFields(log.Fields{
-			"id":       config.Id,
-			"provider": protection.Provider,
-		}).Info("attaching protection for static page")
+	var protector echo.MiddlewareFunc
+	var policy *AccessPolicy
+	if config.Protection != nil {
+		var err error
+		protector, policy, err = w.createProtector(config.Id, config.Protection)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w.pageProtectors[config.Id] = protector
+
+	// the rules for sub paths are evaluated before the protection of the page
+	access := protector
+	var ruleProtectors []echo.MiddlewareFunc
+	var rules []pageRule
+	if len(config.Rules) > 0 {
+		rules = make([]pageRule, 0, len(config.Rules))
+		for _, rule := range config.Rules {
+			if err := validatePageRule(rule); err != nil {
+				log.WithField("id", config.Id).WithError(err).Error("Invalid page rule")
+				return nil, err
+			}
+			compiled := pageRule{path: normalizeRulePath(rule.Path)}
+			if rule.Protection != nil {
+				var err error
+				compiled.protector, compiled.policy, err = w.createProtector(config.Id, rule.Protection)
+				if err != nil {
+					return nil, err
+				}
+				compiled.limits = rule.Protection.ExpressionLimits()
+				ruleProtectors = append(ruleProtectors, compiled.protector)
+			}
+			log.WithFields(log.Fields{
+				"id":     config.Id,
+				"path":   compiled.path,
+				"public": rule.Public,
+			}).Info("attaching rule for static page")
+			rules = append(rules, compiled)
+		}
+		access = newPageRulesMiddleware(baseContentUrl, rules, protector)
+	}
+
+	// denied networks can not use share links or reach the access files
+	if network := newPageNetworkMiddleware(baseContentUrl, rules, policy); network != nil {
+		group.Use(network)
+	}
+	// the access files of the directories are applied after the protection of the page and are never served
+	var files *accessFiles
+	if config.Upstream == nil {
+		// the access files use the providers of the matching rule, public rules use the providers of the page,
+		// so private access files can still require a login
+		resolve := func(relativePath string) ([]string, ExpressionLimits) {
+			if rule, ok := ruleFor(relativePath, rules); ok && rule.policy != nil {
+				return rule.policy.Providers(), rule.limits
+			}
+			if policy != nil {
+				return policy.Providers(), config.Protection.ExpressionLimits()
+			}
+			return nil, ExpressionLimits{}
+		}
+		files = newAccessFiles(config.Id, config.Dir, baseContentUrl, resolve,
+			func(protection *StaticPageProtection) (echo.MiddlewareFunc, error) {
+				protector, _, err := w.createProtector(config.Id, protection)
+				return protector, err
+			})
+		files.discover()
+		group.Use(files.hide)
+	}
+	if config.ShareLinks != nil && config.ShareLinks.Enabled {
+		var err error
+		access, err = w.createPageShareLinks(config, baseContentUrl, access, protector, ruleProtectors, files)
+		if err != nil {
+			log.WithField("id", config.Id).WithError(err).Error("Error enabling share links")
+			return nil, err
+		}
+	}
+	if access != nil {
+		group.Use(access)
+	}
+	if files != nil {
+		group.Use(files.middleware)
+	}
 
-		protector, err := w.oidc.CreateMiddleware(protection)
+	if config.Token != nil {
+		err := w.createPageTokens(group, baseContentUrl, config, protector, policy)
 		if err != nil {
-			log.WithError(err).Error("Error creating protection middleware")
+			log.WithField("id", config.Id).WithError(err).Error("Error creating token endpoint")
 			return nil, err
 		}
-		group.Use(protector)
 	}
 
-	group.Static("/", config.Dir)
+	if config.Upstream != nil {
+		handler, err := newUpstreamHandler(baseContentUrl, config.Upstream)
+		if err != nil {
+			log.WithField("id", config.Id).WithError(err).Error("Error creating upstream proxy")
+			return nil, err
+		}
+		group.Any("", handler)
+		group.Any("/*", handler)
+		log.WithFields(log.Fields{
+			"id":       config.Id,
+			"upstream": config.Upstream.Url,
+		}).Info("proxying static page to upstream")
+	} else {
+		group.Static("/", config.Dir)
+	}
 
 	return group, nil
 }
+
+// createProtector compiles the protection and creates the middleware for it.
+func (w *Webserver) createProtector(pageId string, protection *StaticPageProtection) (echo.MiddlewareFunc, *AccessPolicy, error) {
+	policy, err := w.policies.Compile(protection)
+	if err != nil {
+		log.WithField("id", pageId).WithError(err).Error("Error compiling protection")
+		return nil, nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"id":       pageId,
+		"provider": policy.Providers(),
+		"policy":   protection.Policy,
+	}).Info("attaching protection for static page")
+
+	protector, err := w.oidc.CreateMiddleware(policy)
+	if err != nil {
+		log.WithError(err).Error("Error creating protection middleware")
+		return nil, nil, err
+	}
+	return protector, policy, nil
+}
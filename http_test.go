@@ -3,15 +3,22 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
 	testHelper "oauth-static-webserver/internal/test"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-playground/assert/v2"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/oauth2-proxy/mockoidc"
 	"golang.org/x/net/http2"
 )
@@ -62,6 +69,10 @@ func newHttpTestEnv(t *testing.T, tls *SettingsTLS) httpTestEnv {
 	if err != nil {
 		t.Fatal(err)
 	}
+	err = testHelper.WaitForPort(cfg.Settings.Host.Port, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
 	return httpTestEnv{m, ws, testHelper.HttpClient(t), cfg}
 }
 
@@ -137,6 +148,905 @@ func TestMockOIDCError(t *testing.T) {
 	testGet(3, http.StatusForbidden, "")
 }
 
+func TestLogout(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	testGet := func(page int, expectedStatus int, expectedBody string) {
+		testGet(t, env, page, expectedStatus, expectedBody)
+	}
+	logout := func(path string, expectedStatus int) {
+		t.Helper()
+		res, err := env.Client.Get(env.url(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedStatus, res.StatusCode)
+	}
+
+	// --- global logout ---
+	env.M.QueueUser(User1)
+	testGet(3, 200, "page=3")
+	// redirect to the base url, which does not exist
+	logout("auth/logout", http.StatusNotFound)
+	// session is gone -> new login with user2
+	env.M.QueueUser(User2)
+	testGet(3, 403, "")
+
+	// --- provider logout ---
+	env.resetClient(t)
+	env.M.QueueUser(User1)
+	testGet(3, 200, "page=3")
+	logout("auth/test-1/logout", http.StatusNotFound)
+	env.M.QueueUser(User2)
+	testGet(3, 403, "")
+
+	logout("auth/unknown/logout", http.StatusBadRequest)
+}
+
+func TestProviderChooser(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// without a session, the provider selection page is shown
+	res, err := env.Client.Get(env.url("page5/file.txt?version=2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(body)
+	for _, expected := range []string{
+		`href="/auth/test-1/login?redirect=%2Fpage5%2Ffile.txt%3Fversion%3D2"`,
+		`href="/auth/test-2/login?redirect=%2Fpage5%2Ffile.txt%3Fversion%3D2"`,
+		`<span>test-1</span>`,
+		`<span>Partner Login</span>`,
+		`src="https://partner.example.com/logo.png"`,
+	} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("provider selection page does not contain %s", expected)
+		}
+	}
+
+	// login with the second provider redirects back to the page
+	env.M.QueueUser(User1)
+	res, err = env.Client.Get(env.url("auth/test-2/login?redirect=%2Fpage5%2Ffile.txt%3Fversion%3D2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "/page5/file.txt", res.Request.URL.Path)
+	assert.Equal(t, "version=2", res.Request.URL.RawQuery)
+	testHelper.AssertBodyString(t, res, "page=5")
+
+	// the session of the second provider is accepted, no selection page is shown
+	testGet(t, env, 5, http.StatusOK, "page=5")
+
+	// a page with a single provider still redirects directly to the IdP
+	env.M.QueueUser(User2)
+	testGet(t, env, 2, http.StatusOK, "page=2")
+
+	// not allowed redirect targets are replaced
+	env.resetClient(t)
+	res, err = env.Client.Get(env.url("auth/test-1/login?redirect=https%3A%2F%2Fevil.example.com%2F"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/", res.Request.URL.Path)
+}
+
+func TestBearerToken(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	signToken := func(claims jwt.MapClaims) string {
+		t.Helper()
+		token, err := env.M.Keypair.SignJWT(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	claims := func(groups []string, exp time.Time) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": env.M.Issuer(),
+			"sub": "ci-job",
+			// without configured audience, the client id of the provider is required
+			"aud": env.M.ClientID,
+			// used by the expression of page4
+			"preferred_username": "ci-job",
+			"exp":                exp.Unix(),
+			"iat":                time.Now().Unix(),
+			"groups":             groups,
+		}
+	}
+	// no cookies and no redirects, like a CLI client
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(page int, token string, expectedStatus int) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, env.url(fmt.Sprintf("page%d/file.txt", page)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedStatus, res.StatusCode)
+		return res
+	}
+
+	valid := signToken(claims([]string{"group-test"}, time.Now().Add(time.Hour)))
+	testHelper.AssertBodyString(t, get(2, valid, http.StatusOK), "page=2")
+	testHelper.AssertBodyString(t, get(3, valid, http.StatusOK), "page=3")
+	// group and expression checks are applied without redirect
+	get(3, signToken(claims(nil, time.Now().Add(time.Hour))), http.StatusForbidden)
+	get(4, valid, http.StatusForbidden)
+	// expired or invalid tokens
+	res := get(2, signToken(claims(nil, time.Now().Add(-time.Hour))), http.StatusUnauthorized)
+	assert.Equal(t, `Bearer error="invalid_token"`, res.Header.Get("WWW-Authenticate"))
+	get(2, "not-a-token", http.StatusUnauthorized)
+	otherAudience := claims([]string{"group-test"}, time.Now().Add(time.Hour))
+	otherAudience["aud"] = "other-api"
+	get(2, signToken(otherAudience), http.StatusUnauthorized)
+	// the ID token of a login has the same audience, but is no API credential
+	for _, claim := range []string{"nonce", "at_hash"} {
+		idToken := claims([]string{"group-test"}, time.Now().Add(time.Hour))
+		idToken[claim] = "value"
+		get(2, signToken(idToken), http.StatusUnauthorized)
+	}
+	// public pages ignore the token
+	get(1, "not-a-token", http.StatusOK)
+	// page5 allows test-2 without bearer tokens, test-1 still accepts the token
+	get(5, valid, http.StatusOK)
+}
+
+func TestAPIKey(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	request := func(key string, expectedStatus int) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, env.url("page5/file.txt"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-API-Key", key)
+		res, err := env.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedStatus, res.StatusCode)
+		if expectedStatus == http.StatusOK {
+			testHelper.AssertBodyString(t, res, "page=5")
+		}
+	}
+
+	// the page accepts the OIDC providers or the API key
+	request("ci-key-1", http.StatusOK)
+	request("ci-key-2", http.StatusUnauthorized)
+	testGet(t, env, 5, http.StatusOK, "")
+	// the API key is not accepted by pages with only OIDC providers
+	req, err := http.NewRequest(http.MethodGet, env.url("page3/file.txt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-API-Key", "ci-key-1")
+	req.Header.Set("Accept", "application/json")
+	res, err := env.Client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestLoginRequired(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	type loginRequired struct {
+		Error     string `json:"error"`
+		LoginURL  string `json:"login_url"`
+		Providers []struct {
+			Id       string `json:"id"`
+			LoginURL string `json:"login_url"`
+		} `json:"providers"`
+	}
+	get := func(path string, headers map[string]string) loginRequired {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, env.url(path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		res, err := env.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		var body loginRequired
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	// fetch call from page2 gets the login url back to page2
+	body := get("page2/file.txt", map[string]string{
+		"Accept":         "application/json",
+		"Sec-Fetch-Mode": "cors",
+		"Referer":        env.url("page2/index.html"),
+	})
+	assert.Equal(t, "login_required", body.Error)
+	assert.Equal(t, "/auth/test-1/login?redirect="+url.QueryEscape(env.url("page2/index.html")), body.LoginURL)
+
+	// image load without referer gets the login url back to the image
+	body = get("page2/file.txt", map[string]string{"Accept": "image/png"})
+	assert.Equal(t, "/auth/test-1/login?redirect=%2Fpage2%2Ffile.txt", body.LoginURL)
+
+	// with multiple providers, the login url shows the provider selection
+	body = get("page5/file.txt", map[string]string{"X-Requested-With": "XMLHttpRequest"})
+	assert.Equal(t, "/auth/login?provider=test-1&provider=test-2&redirect=%2Fpage5%2Ffile.txt", body.LoginURL)
+	assert.Equal(t, 2, len(body.Providers))
+
+	// the login url of the response logs in and redirects back
+	env.M.QueueUser(User1)
+	res, err := env.Client.Get(env.url(strings.TrimPrefix(body.Providers[0].LoginURL, "/")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHelper.AssertBodyString(t, res, "page=5")
+
+	// HEAD requests are not redirected
+	env.resetClient(t)
+	res, err = env.Client.Head(env.url("page2/file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
+func TestForwardAuth(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	verify := func(query string, expectedStatus int) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, env.url("auth/verify?"+query), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "app.example.com")
+		req.Header.Set("X-Forwarded-Uri", "/reports?year=2024")
+		res, err := env.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedStatus, res.StatusCode)
+		return res
+	}
+
+	verify("", http.StatusBadRequest)
+	verify("page=unknown", http.StatusNotFound)
+	verify("policy=unknown", http.StatusNotFound)
+	// public page
+	res := verify("page=page-1", http.StatusOK)
+	assert.Equal(t, "", res.Header.Get(HeaderAuthRequestUser))
+
+	// without session, the login returns to the forwarded url
+	res = verify("page=page-2", http.StatusUnauthorized)
+	expectedLogin := env.Config.Content.OIDC.BaseUrl + "/auth/test-1/login?redirect=" +
+		url.QueryEscape("https://app.example.com/reports?year=2024")
+	assert.Equal(t, expectedLogin, res.Header.Get(HeaderAuthRequestLoginUrl))
+
+	// with session of user1
+	env.M.QueueUser(User1)
+	testGet(t, env, 2, http.StatusOK, "page=2")
+	res = verify("page=page-2", http.StatusOK)
+	assert.Equal(t, "1", res.Header.Get(HeaderAuthRequestUser))
+	assert.Equal(t, "mocker1", res.Header.Get(HeaderAuthRequestPreferredUsername))
+	assert.Equal(t, "group-test", res.Header.Get(HeaderAuthRequestGroups))
+	verify("policy=group-test", http.StatusOK)
+
+	// with session of user2 without group
+	env.resetClient(t)
+	env.M.QueueUser(User2)
+	testGet(t, env, 2, http.StatusOK, "page=2")
+	verify("page=page-3", http.StatusForbidden)
+	verify("policy=group-test", http.StatusForbidden)
+}
+
+func TestTokenEndpoint(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	request := func(path string, headers map[string]string, expectedStatus int) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, env.url(path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Requested-With", "XMLHttpRequest")
+		for name, value := range headers {
+			if value == "" {
+				req.Header.Del(name)
+			} else {
+				req.Header.Set(name, value)
+			}
+		}
+		res, err := env.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedStatus, res.StatusCode)
+		return res
+	}
+	token := func() tokenResponse {
+		t.Helper()
+		res := request("auth/test-1/token?page=page-2", nil, http.StatusOK)
+		assert.Equal(t, "no-store", res.Header.Get("Cache-Control"))
+		var body tokenResponse
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	// without session
+	request("auth/test-1/token?page=page-2", nil, http.StatusUnauthorized)
+
+	// short-lived access token, which is refreshed by the token endpoint
+	env.M.AccessTTL = 10 * time.Second
+	env.M.QueueUser(User1)
+	testGet(t, env, 2, http.StatusOK, "page=2")
+	env.M.AccessTTL = time.Hour
+
+	first := token()
+	assert.Equal(t, "Bearer", first.TokenType)
+	if first.ExpiresIn < 10*60 {
+		t.Errorf("expected a refreshed token, expires in %d seconds", first.ExpiresIn)
+	}
+	second := token()
+	assert.Equal(t, first.AccessToken, second.AccessToken)
+
+	// CSRF protection and opt-in
+	request("auth/test-1/token?page=page-2", map[string]string{"X-Requested-With": ""}, http.StatusForbidden)
+	request("auth/test-1/token?page=page-2", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden)
+	request("auth/test-1/token?page=page-2", map[string]string{"Origin": "https://evil.example.com"}, http.StatusForbidden)
+	request("auth/test-1/token?page=page-3", nil, http.StatusNotFound)
+	request("auth/test-2/token?page=page-2", nil, http.StatusBadRequest)
+
+	// the relay calls the userinfo endpoint of the IdP with the access token
+	res := request("page2/api/userinfo", nil, http.StatusOK)
+	testHelper.AssertBodyString(t, res, `{"preferred_username":"mocker1","groups":["group-test"]}`)
+	request("page2/api/userinfo", map[string]string{"X-Requested-With": ""}, http.StatusForbidden)
+}
+
+func TestShareLinks(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	post := func(path string, body url.Values, headers map[string]string, expectedStatus int) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, env.url(path), strings.NewReader(body.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Requested-With", "XMLHttpRequest")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		res, err := env.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedStatus, res.StatusCode)
+		return res
+	}
+	share := func(body url.Values) shareLinkResponse {
+		t.Helper()
+		res := post("auth/share?page=page-3", body, nil, http.StatusOK)
+		var link shareLinkResponse
+		if err := json.NewDecoder(res.Body).Decode(&link); err != nil {
+			t.Fatal(err)
+		}
+		return link
+	}
+	// the auditor has no session
+	auditor := &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	anonymous := func(link string, expectedStatus int) {
+		t.Helper()
+		res, err := auditor.Get(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedStatus, res.StatusCode)
+		if expectedStatus == http.StatusOK {
+			assert.Equal(t, "no-referrer", res.Header.Get("Referrer-Policy"))
+			testHelper.AssertBodyString(t, res, "page=3")
+		}
+	}
+
+	// without session
+	post("auth/share?page=page-3", url.Values{"path": {"/file.txt"}}, nil, http.StatusUnauthorized)
+
+	env.M.QueueUser(User1)
+	testGet(t, env, 3, http.StatusOK, "page=3")
+
+	link := share(url.Values{"path": {"file.txt"}})
+	anonymous(link.Url, http.StatusOK)
+	anonymous(link.Url, http.StatusOK)
+	anonymous(strings.Replace(link.Url, "file.txt", "other.txt", 1), http.StatusForbidden)
+	anonymous(strings.Replace(link.Url, "/page3/", "/page2/", 1), http.StatusFound)
+	anonymous(strings.Replace(link.Url, "?share=", "?other=", 1), http.StatusFound)
+	anonymous(link.Url+"x", http.StatusForbidden)
+
+	// the path of the link is escaped
+	if err := os.WriteFile(filepath.Join(env.Config.Content.StaticPages[2].Dir, "report #1?.txt"), []byte("page=3"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	escaped := share(url.Values{"path": {"/report #1?.txt"}})
+	assert.Equal(t, strings.HasPrefix(escaped.Url, env.url("page3/report%20%231%3F.txt?share=")), true)
+	anonymous(escaped.Url, http.StatusOK)
+
+	// networks, which bypass the login, can not create links without a login
+	post("auth/share?page=office", url.Values{"path": {"/file.txt"}}, nil, http.StatusUnauthorized)
+	officeToken, err := env.WS.shareLinks.signer.sign(shareLink{Id: "office-link", Page: "office", Path: "/file.txt", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post("auth/share/revoke?page=office", url.Values{"token": {officeToken}}, nil, http.StatusUnauthorized)
+
+	// max uses
+	limited := share(url.Values{"path": {"/"}, "prefix": {"true"}, "max_uses": {"2"}, "ttl": {"10m"}})
+	limitedUrl := strings.Replace(limited.Url, "/page3/?", "/page3/file.txt?", 1)
+	anonymous(limitedUrl, http.StatusOK)
+	anonymous(limitedUrl, http.StatusOK)
+	anonymous(limitedUrl, http.StatusGone)
+
+	// revocation
+	post("auth/share/revoke?page=page-3", url.Values{"token": {link.Token}}, nil, http.StatusNoContent)
+	anonymous(link.Url, http.StatusGone)
+	post("auth/share/revoke?page=page-3", url.Values{"token": {link.Token + "x"}}, nil, http.StatusBadRequest)
+
+	// paths restricted by an access file can not be shared, also not by a prefix link above them
+	restrictedDir := filepath.Join(env.Config.Content.StaticPages[2].Dir, "restricted")
+	if err := os.MkdirAll(restrictedDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(restrictedDir, ".access.yaml"), []byte("groups:\n  - group-test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	post("auth/share?page=page-3", url.Values{"path": {"/restricted/file.txt"}}, nil, http.StatusForbidden)
+	post("auth/share?page=page-3", url.Values{"path": {"/"}, "prefix": {"true"}}, nil, http.StatusForbidden)
+	share(url.Values{"path": {"/file.txt"}})
+
+	// limits, CSRF protection and opt-in
+	post("auth/share?page=page-3", url.Values{"path": {"/file.txt"}, "ttl": {"2h"}}, nil, http.StatusBadRequest)
+	post("auth/share?page=page-3", url.Values{}, nil, http.StatusBadRequest)
+	post("auth/share?page=page-3", url.Values{"path": {"/file.txt"}}, map[string]string{"Origin": "https://evil.example.com"}, http.StatusForbidden)
+	post("auth/share?page=page-2", url.Values{"path": {"/file.txt"}}, nil, http.StatusNotFound)
+
+	// the user must have access to the shared path
+	env.resetClient(t)
+	env.M.QueueUser(User2)
+	testGet(t, env, 2, http.StatusOK, "page=2")
+	post("auth/share?page=page-3", url.Values{"path": {"/file.txt"}}, nil, http.StatusForbidden)
+}
+
+func TestNetworkRules(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// the local network bypasses the login
+	res, err := env.Client.Get(env.url("office/file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "/office/file.txt", res.Request.URL.Path)
+	testHelper.AssertBodyString(t, res, "page=1")
+
+	// denied networks are denied even with a session
+	env.M.QueueUser(User1)
+	testGet(t, env, 2, http.StatusOK, "page=2")
+	res, err = env.Client.Get(env.url("external/file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	// the X-Forwarded-For header is ignored without trusted proxies
+	req, err := http.NewRequest(http.MethodGet, env.url("external/file.txt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	res, err = env.Client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	// a share link, which was created from an allowed network, can not be used from a denied network
+	token, err := env.WS.shareLinks.signer.sign(shareLink{
+		Id:        "external-link",
+		Page:      "external",
+		Path:      "/file.txt",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = testHelper.HttpClient(t).Get(env.url("external/file.txt?share=" + url.QueryEscape(token)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	testHelper.AssertBodyString(t, res, "Access from your network is not allowed.")
+}
+
+func TestAccessFiles(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// page-2 only requires a login, the access file requires the group of user1
+	reportsDir := filepath.Join(env.Config.Content.StaticPages[1].Dir, "reports")
+	writeFile := func(name, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(reportsDir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(reportsDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("file.txt", "reports")
+	writeFile("public/file.txt", "public reports")
+	writeFile(".access.yaml", "groups:\n  - group-test\n")
+	writeFile("public/.access.yaml", "")
+	get := func(path string, expectedStatus int, expectedBody string) {
+		t.Helper()
+		res, err := env.Client.Get(env.url(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedStatus, res.StatusCode)
+		if expectedBody != "" {
+			testHelper.AssertBodyString(t, res, expectedBody)
+		}
+	}
+
+	env.M.QueueUser(User2)
+	get("page2/file.txt", http.StatusOK, "page=2")
+	get("page2/reports/file.txt", http.StatusForbidden, "")
+	// a sub directory keeps the restrictions of the parent access files
+	get("page2/reports/public/file.txt", http.StatusForbidden, "")
+	// the access files are never served
+	get("page2/reports/.access.yaml", http.StatusNotFound, "")
+	get("page2/reports/public/%2eaccess.yaml", http.StatusNotFound, "")
+
+	env.M.QueueUser(User1)
+	env.resetClient(t)
+	get("page2/reports/file.txt", http.StatusOK, "reports")
+	get("page2/reports/public/file.txt", http.StatusOK, "public reports")
+
+	// changed files are reloaded
+	writeFile(".access.yaml", "expression: 'user.preferred_username == \"mocker2\"'\n")
+	get("page2/reports/file.txt", http.StatusForbidden, "")
+	// invalid files deny the access
+	writeFile(".access.yaml", "group: typo\n")
+	get("page2/reports/file.txt", http.StatusInternalServerError, "")
+	get("page2/file.txt", http.StatusOK, "page=2")
+
+	// the unprotected page-1 protects the partner directory by a rule with the provider test-2,
+	// the access file uses the provider of the rule
+	partnerDir := filepath.Join(env.Config.Content.StaticPages[0].Dir, "partner")
+	if err := os.MkdirAll(partnerDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(partnerDir, "file.txt"), []byte("partner"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(partnerDir, ".access.yaml"), []byte("groups:\n  - group-test\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	env.M.QueueUser(User1)
+	res, err := env.Client.Get(env.url("page1/partner/file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "/auth/test-2/callback", res.Request.Response.Request.URL.Path)
+	testHelper.AssertBodyString(t, res, "partner")
+}
+
+func TestPKCE(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// record the challenge method of all auth requests
+	var methods []string
+	recordAuth := func(req *http.Request, via []*http.Request) error {
+		if strings.HasSuffix(req.URL.Path, "/authorize") {
+			methods = append(methods, req.URL.Query().Get("code_challenge_method"))
+		}
+		return nil
+	}
+	env.Client.CheckRedirect = recordAuth
+
+	testGet(t, env, 2, 200, "page=2")
+
+	// disable PKCE for the provider
+	disabled := false
+	env.WS.oidc.providers["test-1"].cfg.PKCE = &disabled
+	env.resetClient(t)
+	env.Client.CheckRedirect = recordAuth
+	testGet(t, env, 2, 200, "page=2")
+
+	assert.Equal(t, methods, []string{"S256", ""})
+}
+
+func TestNonce(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	var nonces []string
+	env.Client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if strings.HasSuffix(req.URL.Path, "/authorize") {
+			nonces = append(nonces, req.URL.Query().Get("nonce"))
+		}
+		return nil
+	}
+
+	testGet(t, env, 2, 200, "page=2")
+	env.Client.Jar, _ = cookiejar.New(nil)
+	testGet(t, env, 2, 200, "page=2")
+
+	assert.Equal(t, len(nonces), 2)
+	assert.NotEqual(t, nonces[0], "")
+	assert.NotEqual(t, nonces[0], nonces[1])
+
+	// the IdP returns an ID token with a wrong or without nonce
+	for _, nonce := range []string{"wrong-nonce", ""} {
+		env.Client.Jar, _ = cookiejar.New(nil)
+		env.Client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if strings.HasSuffix(req.URL.Path, "/authorize") {
+				query := req.URL.Query()
+				if nonce == "" {
+					query.Del("nonce")
+				} else {
+					query.Set("nonce", nonce)
+				}
+				req.URL.RawQuery = query.Encode()
+			}
+			return nil
+		}
+		testGet(t, env, 2, http.StatusUnauthorized, "nonce mismatch")
+	}
+}
+
+func TestExtraAuthParams(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	provider := env.WS.oidc.providers["test-1"]
+	provider.authOptions = buildAuthOptions(OIDCProvider{
+		ExtraAuthParams: map[string]string{
+			"prompt":     "login",
+			"login_hint": "mocker1",
+		},
+	})
+	var params []url.Values
+	env.Client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if strings.HasSuffix(req.URL.Path, "/authorize") {
+			params = append(params, req.URL.Query())
+		}
+		return nil
+	}
+
+	env.M.QueueUser(User1)
+	testGet(t, env, 2, 200, "page=2")
+
+	assert.Equal(t, len(params), 1)
+	assert.Equal(t, params[0].Get("prompt"), "login")
+	assert.Equal(t, params[0].Get("login_hint"), "mocker1")
+	// the extra params are sent next to the params of the flow
+	assert.NotEqual(t, params[0].Get("nonce"), "")
+}
+
+func TestRefreshToken(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	authRequests := 0
+	env.Client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if strings.HasSuffix(req.URL.Path, "/authorize") {
+			authRequests++
+		}
+		return nil
+	}
+
+	// very short-lived access token
+	env.M.AccessTTL = time.Second
+	env.M.QueueUser(User1)
+	testGet(t, env, 3, 200, "page=3")
+	assert.Equal(t, authRequests, 1)
+
+	// wait until the access token is expired -> silent renewal without IdP redirect
+	time.Sleep(2100 * time.Millisecond)
+	env.M.AccessTTL = time.Hour
+	testGet(t, env, 3, 200, "page=3")
+	assert.Equal(t, authRequests, 1)
+}
+
+func TestParallelLogins(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// follow the redirects step by step
+	env.Client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	step := func(url string, expectedStatus int) string {
+		t.Helper()
+		res, err := env.Client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expectedStatus, res.StatusCode)
+		return res.Header.Get("Location")
+	}
+
+	// two tabs start a login
+	authPage2 := step(env.url("page2/file.txt?version=2"), http.StatusFound)
+	authPage3 := step(env.url("page3/file.txt"), http.StatusFound)
+
+	// finish the logins in reverse order
+	callbackPage3 := step(authPage3, http.StatusFound)
+	assert.Equal(t, step(callbackPage3, http.StatusFound), "/page3/file.txt")
+	callbackPage2 := step(authPage2, http.StatusFound)
+	assert.Equal(t, step(callbackPage2, http.StatusFound), "/page2/file.txt?version=2")
+
+	// the state can only be used once
+	step(callbackPage2, http.StatusUnauthorized)
+
+	// two tabs start a login at the same time: the second request does not carry the cookies of the first response
+	env.resetClient(t)
+	env.Client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	authPage2 = step(env.url("page2/file.txt"), http.StatusFound)
+	tab := testHelper.HttpClient(t)
+	tab.CheckRedirect = env.Client.CheckRedirect
+	res, err := tab.Get(env.url("page3/file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	authPage3 = res.Header.Get("Location")
+	baseUrl, _ := url.Parse(env.url(""))
+	env.Client.Jar.SetCookies(baseUrl, res.Cookies())
+
+	callbackPage2 = step(authPage2, http.StatusFound)
+	assert.Equal(t, step(callbackPage2, http.StatusFound), "/page2/file.txt")
+	callbackPage3 = step(authPage3, http.StatusFound)
+	assert.Equal(t, step(callbackPage3, http.StatusFound), "/page3/file.txt")
+}
+
+func TestGroupsClaimSource(t *testing.T) {
+	env := newHttpTestEnv(t, &SettingsTLS{Enabled: false})
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	provider := env.WS.oidc.providers["test-1"]
+
+	// the groups are also part of the user info
+	provider.cfg.GroupsClaim.Source = GroupsSourceUserInfo
+	env.M.QueueUser(User1)
+	testGet(t, env, 3, 200, "page=3")
+
+	// the access token of mockoidc contains no groups
+	provider.cfg.GroupsClaim.Source = GroupsSourceAccessToken
+	env.resetClient(t)
+	env.M.QueueUser(User1)
+	testGet(t, env, 3, 403, "")
+}
+
 // ------ TEST TLS and HTTP2 ------
 
 func TestHttp2(t *testing.T) {
@@ -34,8 +34,8 @@ func PrepareContentFolder() (func(), string, error) {
 	if err != nil {
 		return nil, "", err
 	}
-	// create 3 page dirs with file.txt (content the counter 1 to 4)
-	for i := 0; i < 4; i++ {
+	// create 5 page dirs with file.txt (content the counter 1 to 5)
+	for i := 0; i < 5; i++ {
 		pageDir := fmt.Sprintf("%s/page%d", dirName, i+1)
 		err := os.Mkdir(pageDir, 0o755)
 		if err != nil {
@@ -97,6 +97,22 @@ func GetFreePort() (port int, err error) {
 	return
 }
 
+// WaitForPort waits until the local port accepts connections or the timeout is reached.
+func WaitForPort(port int, timeout time.Duration) error {
+	address := fmt.Sprintf("localhost:%d", port)
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err == nil {
+			return conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // CreateTempCert creates a temporary self-signed certificate and key for testing purposes.
 // It returns a cleanup function to remove the temporary files, along with the paths to the certificate and key.
 func CreateTempCert(t *testing.T) (func(), string, string) {
@@ -29,7 +29,7 @@ func main() {
 }
 
 func StartServer(cfg *Config) error {
-	oidc, err := NewFromConfig(cfg.Content.OIDC.Providers, cfg.Content.OIDC.BaseUrl)
+	oidc, err := NewFromConfig(cfg)
 	if err != nil {
 		return err
 	}
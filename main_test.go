@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"oauth-static-webserver/internal/test"
 	"os"
+	"time"
 
 	"github.com/oauth2-proxy/mockoidc"
 )
@@ -32,6 +33,38 @@ func CreateConfig(m *mockoidc.MockOIDC, sessionPath, staticPath string, tls *Set
 						ConfigUrl:    m.DiscoveryEndpoint(),
 						ClientID:     m.ClientID,
 						ClientSecret: m.ClientSecret,
+						BearerTokens: OIDCBearerTokens{
+							Enabled: true,
+						},
+					},
+					{
+						Id:           "test-2",
+						ConfigUrl:    m.DiscoveryEndpoint(),
+						ClientID:     m.ClientID,
+						ClientSecret: m.ClientSecret,
+						DisplayName:  "Partner Login",
+						LogoUrl:      "https://partner.example.com/logo.png",
+					},
+				},
+			},
+			APIKeys: []APIKeyProvider{
+				{
+					Id: "machines",
+					Keys: []APIKey{
+						{
+							Name:   "ci",
+							Hash:   "sha256:89f2a002bebe61bbae4cc87b61a1dcb12602668b44fcf476eba26aed2d5ca0b4", // ci-key-1
+							Groups: []string{"ci"},
+						},
+					},
+				},
+			},
+			Policies: []NamedPolicy{
+				{
+					Id: "group-test",
+					StaticPageProtection: StaticPageProtection{
+						Provider: "test-1",
+						Groups:   []string{"group-test"},
 					},
 				},
 			},
@@ -41,6 +74,12 @@ func CreateConfig(m *mockoidc.MockOIDC, sessionPath, staticPath string, tls *Set
 					Dir:        fmt.Sprintf("%s/page1", staticPath),
 					Url:        "/page1",
 					Protection: nil,
+					Rules: []StaticPageRule{
+						{
+							Path:       "/partner/**",
+							Protection: &StaticPageProtection{Provider: "test-2"},
+						},
+					},
 				},
 				{
 					Id:  "page-2",
@@ -50,6 +89,18 @@ func CreateConfig(m *mockoidc.MockOIDC, sessionPath, staticPath string, tls *Set
 						Provider: "test-1",
 						Groups:   nil,
 					},
+					Token: &StaticPageToken{
+						Endpoint: true,
+						Relay: []StaticPageTokenRelay{
+							{
+								Path: "/api",
+								StaticPageUpstream: StaticPageUpstream{
+									Url:       m.Issuer(),
+									StripPath: true,
+								},
+							},
+						},
+					},
 				},
 				{
 					Id:  "page-3",
@@ -59,6 +110,10 @@ func CreateConfig(m *mockoidc.MockOIDC, sessionPath, staticPath string, tls *Set
 						Provider: "test-1",
 						Groups:   []string{"group-test"},
 					},
+					ShareLinks: &StaticPageShareLinks{
+						Enabled: true,
+						MaxTTL:  time.Hour,
+					},
 				},
 				{
 					Id:  "page-4",
@@ -69,6 +124,40 @@ func CreateConfig(m *mockoidc.MockOIDC, sessionPath, staticPath string, tls *Set
 						Expression: `text.contains(user.preferred_username, "er2")`,
 					},
 				},
+				{
+					Id:  "page-5",
+					Dir: fmt.Sprintf("%s/page5", staticPath),
+					Url: "/page5",
+					Protection: &StaticPageProtection{
+						Providers: []string{"test-1", "test-2", "machines"},
+					},
+				},
+				{
+					Id:  "office",
+					Dir: fmt.Sprintf("%s/page1", staticPath),
+					Url: "/office",
+					Protection: &StaticPageProtection{
+						Provider:       "test-1",
+						BypassAuthFrom: []string{"127.0.0.1", "::1"},
+					},
+					ShareLinks: &StaticPageShareLinks{
+						Enabled: true,
+						MaxTTL:  time.Hour,
+					},
+				},
+				{
+					Id:  "external",
+					Dir: fmt.Sprintf("%s/page1", staticPath),
+					Url: "/external",
+					Protection: &StaticPageProtection{
+						Provider:  "test-1",
+						DenyCIDRs: []string{"127.0.0.0/8", "::1"},
+					},
+					ShareLinks: &StaticPageShareLinks{
+						Enabled: true,
+						MaxTTL:  time.Hour,
+					},
+				},
 			},
 		},
 	}
@@ -91,7 +180,14 @@ func SetupSWS(tls *SettingsTLS) (*Config, *mockoidc.MockOIDC, *Webserver, error)
 		return nil, nil, nil, err
 	}
 	cfg := CreateConfig(m, sessionStorage, contentPath, tls)
-	oidc, err := NewFromConfig(cfg.Content.OIDC.Providers, cfg.Content.OIDC.BaseUrl)
+	err = cfg.Process()
+	if err != nil {
+		_ = m.Shutdown()
+		rm()
+		_ = os.RemoveAll(sessionStorage)
+		return nil, nil, nil, err
+	}
+	oidc, err := NewFromConfig(&cfg)
 	if err != nil {
 		_ = m.Shutdown()
 		rm()
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// parseCIDRs parses a list of CIDRs. Single IPs are converted into a CIDR for only this IP.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	cidrs := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", value)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			value = fmt.Sprintf("%s/%d", value, bits)
+		}
+		_, cidr, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// ipInCIDRs checks if the ip is part of one of the CIDRs.
+func ipInCIDRs(ip net.IP, cidrs []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RFC 7239 header, which the trusted proxies can use for the client IP
+const HeaderForwarded = "Forwarded"
+
+// newIPExtractor creates the extractor for the client IP of a request.
+// The header is only used, when the request comes from one of the trusted proxies.
+// The addresses of the header are read from right to left and the first address, which is no trusted proxy, is the client.
+// Without trusted proxies, the address of the direct connection is used.
+func newIPExtractor(trustedProxies []*net.IPNet, header string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	if header == "" {
+		header = echo.HeaderXForwardedFor
+	}
+	header = http.CanonicalHeaderKey(header)
+	switch header {
+	case echo.HeaderXForwardedFor, HeaderForwarded, echo.HeaderXRealIP:
+	default:
+		return nil, fmt.Errorf("unsupported client IP header: %s", header)
+	}
+
+	direct := echo.ExtractIPDirect()
+	return func(r *http.Request) string {
+		client := remoteIP(r.RemoteAddr)
+		if !ipInCIDRs(client, trustedProxies) {
+			return direct(r)
+		}
+		addresses := forwardedAddresses(r.Header, header)
+		for i := len(addresses) - 1; i >= 0; i-- {
+			ip := net.ParseIP(addresses[i])
+			// obfuscated or unknown addresses can not be checked, the last proxy is used
+			if ip == nil {
+				break
+			}
+			client = ip
+			if !ipInCIDRs(ip, trustedProxies) {
+				break
+			}
+		}
+		return client.String()
+	}, nil
+}
+
+// remoteIP returns the IP of the remote address of a connection.
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedAddresses returns the client addresses of all values of the header in order.
+func forwardedAddresses(header http.Header, name string) []string {
+	var addresses []string
+	for _, value := range header.Values(name) {
+		for _, element := range strings.Split(value, ",") {
+			element = strings.TrimSpace(element)
+			if name != HeaderForwarded {
+				addresses = append(addresses, element)
+				continue
+			}
+			// RFC 7239, e.g. for=192.0.2.60;proto=http;by=203.0.113.43
+			for _, pair := range strings.Split(element, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(key, "for") {
+					addresses = append(addresses, forwardedNode(value))
+				}
+			}
+		}
+	}
+	return addresses
+}
+
+// forwardedNode returns the IP of a node of the Forwarded header without quotes, brackets and port,
+// e.g. "[2001:db8:cafe::17]:4711" or 192.0.2.43:47011.
+func forwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		host, _, _ := strings.Cut(node[1:], "]")
+		return host
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/labstack/echo/v4"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	cidrs, err := parseCIDRs([]string{"10.0.0.0/8", " 192.168.1.1 ", "", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(cidrs), 3)
+	assert.Equal(t, ipInCIDRs(net.ParseIP("10.1.2.3"), cidrs), true)
+	assert.Equal(t, ipInCIDRs(net.ParseIP("192.168.1.1"), cidrs), true)
+	assert.Equal(t, ipInCIDRs(net.ParseIP("192.168.1.2"), cidrs), false)
+	assert.Equal(t, ipInCIDRs(net.ParseIP("::1"), cidrs), true)
+	assert.Equal(t, ipInCIDRs(nil, cidrs), false)
+
+	_, err = parseCIDRs([]string{"no-ip"})
+	assert.NotEqual(t, err, nil)
+	_, err = parseCIDRs([]string{"10.0.0.0/99"})
+	assert.NotEqual(t, err, nil)
+}
+
+func TestIPExtractor(t *testing.T) {
+	extractor := func(trusted []*net.IPNet, header string) echo.IPExtractor {
+		t.Helper()
+		extract, err := newIPExtractor(trusted, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return extract
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("X-Real-IP", "203.0.113.8")
+
+	// without trusted proxies the headers are ignored
+	assert.Equal(t, extractor(nil, "")(req), "10.0.0.1")
+
+	trusted, err := parseCIDRs([]string{"10.0.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, extractor(trusted, "")(req), "203.0.113.7")
+	assert.Equal(t, extractor(trusted, "x-real-ip")(req), "203.0.113.8")
+
+	// untrusted proxy
+	req.RemoteAddr = "10.0.1.1:1234"
+	assert.Equal(t, extractor(trusted, "")(req), "10.0.1.1")
+
+	_, err = newIPExtractor(trusted, "X-Client-IP")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestIPExtractorChain(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/24", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		header   string
+		values   []string
+		expected string
+	}{
+		// the client can prepend spoofed addresses, the first untrusted address from the right is used
+		{"X-Forwarded-For", []string{"198.51.100.1, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"X-Forwarded-For", []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7"},
+		{"X-Forwarded-For", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"X-Forwarded-For", []string{"unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"X-Forwarded-For", nil, "10.0.0.1"},
+		{"Forwarded", []string{`for=198.51.100.1, for="203.0.113.7:4711";proto=https, for=10.0.0.2`}, "203.0.113.7"},
+		{"Forwarded", []string{`for="[2001:db9::17]:4711", for="[2001:db8::1]"`}, "2001:db9::17"},
+		{"Forwarded", []string{`for=_hidden;by=10.0.0.1`}, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		extract, err := newIPExtractor(trusted, test.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		for _, value := range test.values {
+			req.Header.Add(test.header, value)
+		}
+		assert.Equal(t, extract(req), test.expected)
+	}
+}
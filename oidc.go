@@ -3,9 +3,13 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
@@ -16,35 +20,61 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+var (
+	ErrOIDCUserInfo       = errors.New("failed to get user info")
+	ErrOIDCUserInfoClaims = errors.New("failed to parse user info claims")
+	ErrOIDCClaims         = errors.New("failed to parse claims")
+	ErrOIDCTokenEncrypt   = errors.New("failed to encrypt token")
+	ErrOIDCNoRefreshToken = errors.New("no refresh token in session")
+	ErrOIDCNoSession      = errors.New("no session for the provider")
+)
+
+// access tokens are refreshed before they are handed out, when they expire within this duration
+const accessTokenLeeway = 30 * time.Second
+
 type OIDC struct {
 	providers Providers
 	baseUrl   string
+	cfg       *Config
+	// encrypts the tokens stored in the session
+	cipher *tokenCipher
+	// basic auth and API key providers by id
+	credentials map[string]credentialProvider
 }
 
-func New(providers Providers, baseUrl string) *OIDC {
-	return &OIDC{
-		providers: providers,
-		baseUrl:   baseUrl,
+func New(providers Providers, cfg *Config) (*OIDC, error) {
+	cipher, err := newTokenCipher(cfg.Settings.Session.Key)
+	if err != nil {
+		log.WithError(err).Error("Failed to create token cipher")
+		return nil, err
 	}
-}
-
-func NewFromConfig(cfg []OIDCProvider, baseUrl string) (*OIDC, error) {
-	ps, err := newProviders(cfg, baseUrl)
+	credentials, err := newCredentialProviders(&cfg.Content)
 	if err != nil {
+		log.WithError(err).Error("Failed to create credential providers")
 		return nil, err
 	}
-	return New(ps, baseUrl), nil
+	return &OIDC{
+		providers:   providers,
+		baseUrl:     cfg.Content.OIDC.BaseUrl,
+		cfg:         cfg,
+		cipher:      cipher,
+		credentials: credentials,
+	}, nil
 }
 
-type jwtClaims struct {
-	Subject string   `json:"sub"`
-	Groups  []string `json:"groups"`
+func NewFromConfig(cfg *Config) (*OIDC, error) {
+	ps, err := newProviders(cfg.Content.OIDC.Providers, cfg.Content.OIDC.BaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	return New(ps, cfg)
 }
 
 // CreateCallbackHandler create a callback handler for all providers by using the
 // parameter "provider" to auth on the right OIDC Provider.
-// It verifies the state, gets the token and user info, saves them in the session
-// and redirect to the original target url.
+// It consumes the auth transaction of the state, gets the token and user info,
+// saves them in the session and redirect to the original target url.
+// The state and code are read from the query or from the form (response_mode=form_post).
 func (o *OIDC) CreateCallbackHandler() echo.HandlerFunc {
 	return func(c echo.Context) error {
 		ctx := context.Background()
@@ -62,35 +92,37 @@ func (o *OIDC) CreateCallbackHandler() echo.HandlerFunc {
 			return c.String(http.StatusInternalServerError, "failed to get session")
 		}
 
-		// collect and check state to prevent CSRF
-		receivedState := c.QueryParam("state")
-		expectedState, ok := sess.Values["state"].(string)
-		if !ok || receivedState != expectedState {
+		// consume the transaction of the state to prevent CSRF and replays
+		ttl := o.cfg.Content.OIDC.TransactionTTL
+		transaction, ok, err := consumeAuthTransaction(c, c.FormValue("state"), ttl)
+		if err != nil {
+			log.WithError(err).Error("Failed to delete auth transaction")
+			return c.String(http.StatusInternalServerError, "failed to save session")
+		}
+		if !ok || transaction.Provider != providerId {
 			log.Debugf("OIDC state mismatch for provider %s", providerId)
 			return c.String(http.StatusUnauthorized, "state mismatch")
 		}
 
-		code := c.QueryParam("code")
+		code := c.FormValue("code")
 		if code == "" {
 			log.Debugf("OIDC code missing from provider %s", providerId)
 			return c.String(http.StatusBadRequest, "code parameter missing")
 		}
 
-		oauth2Token, err := oidcProv.oauth2Config.Exchange(ctx, code)
-		if err != nil {
-			log.WithError(err).Error("Failed to get token")
-			return c.String(http.StatusInternalServerError, "failed to get token")
+		var exchangeOpts []oauth2.AuthCodeOption
+		if oidcProv.cfg.PKCEEnabled() {
+			if transaction.Verifier == "" {
+				log.Debugf("OIDC code verifier missing for provider %s", providerId)
+				return c.String(http.StatusUnauthorized, "code verifier missing")
+			}
+			exchangeOpts = append(exchangeOpts, oauth2.VerifierOption(transaction.Verifier))
 		}
 
-		ui, err := oidcProv.provider.UserInfo(ctx, oauth2.StaticTokenSource(oauth2Token))
+		oauth2Token, err := oidcProv.oauth2Config.Exchange(ctx, code, exchangeOpts...)
 		if err != nil {
-			log.WithError(err).Error("Failed to get user info")
-			return c.String(http.StatusInternalServerError, "failed to get user info")
-		}
-		var uiClaims map[string]any
-		if err := ui.Claims(&uiClaims); err != nil {
-			log.WithError(err).Error("Failed to parse user info claims")
-			return c.String(http.StatusInternalServerError, "failed to parse user info claims")
+			log.WithError(err).Error("Failed to get token")
+			return c.String(http.StatusInternalServerError, "failed to get token")
 		}
 
 		rawIDToken, ok := oauth2Token.Extra("id_token").(string)
@@ -99,35 +131,37 @@ func (o *OIDC) CreateCallbackHandler() echo.HandlerFunc {
 			return c.String(http.StatusInternalServerError, "no id_token in token response")
 		}
 
-		verifier := oidcProv.provider.Verifier(&oidc.Config{ClientID: oidcProv.oauth2Config.ClientID})
-		idToken, err := verifier.Verify(ctx, rawIDToken)
+		idToken, err := oidcProv.verifyIDToken(ctx, rawIDToken)
 		if err != nil {
 			log.WithError(err).Error("Failed to verify token")
 			return c.String(http.StatusUnauthorized, "failed to verify ID token")
 		}
 
-		// collect claims from id token
-		var idTokenClaims jwtClaims
-		if err := idToken.Claims(&idTokenClaims); err != nil {
-			log.WithError(err).Error("Failed to parse claims")
-			return c.String(http.StatusInternalServerError, "failed to parse claims")
+		// check nonce to prevent replay of ID tokens
+		if transaction.Nonce == "" ||
+			subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(transaction.Nonce)) != 1 {
+			log.Debugf("OIDC nonce mismatch for provider %s", providerId)
+			return c.String(http.StatusUnauthorized, "nonce mismatch")
+		}
+
+		providerSession, err := o.newProviderSession(ctx, oidcProv, oauth2Token, idToken, rawIDToken)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
 		}
 
 		providerSessions, ok := sess.Values[providerSessionsKey].(map[string]ProviderSession)
 		if !ok || providerSessions == nil {
 			providerSessions = make(map[string]ProviderSession)
 		}
-		providerSessions[providerId] = ProviderSession{
-			ExpiresAt: oauth2Token.Expiry.Unix(),
-			Subject:   idTokenClaims.Subject,
-			Groups:    idTokenClaims.Groups,
-			UserInfo:  uiClaims,
-		}
+		providerSessions[providerId] = providerSession
 		sess.Values[providerSessionsKey] = providerSessions
 
-		// store original target url
-		redirectURL, _ := sess.Values["original_path"].(string)
-		if redirectURL == "" {
+		// original target url of the login, only if it is a safe target
+		redirectURL := transaction.TargetURL
+		if !o.isAllowedRedirect(redirectURL) {
+			if redirectURL != "" {
+				log.WithField("target", redirectURL).Warn("Redirect target after login is not allowed")
+			}
 			redirectURL = "/"
 		}
 		// save session
@@ -140,112 +174,530 @@ func (o *OIDC) CreateCallbackHandler() echo.HandlerFunc {
 	}
 }
 
-// CreateMiddleware create a middleware, which protect all following routes.
-// It checks for user auth and redirect to IdP auth url if needed or redirect to an error page.
-// The user must be in one of the allowedGroups to pass the auth test.
-// If the list is empty, then the group check is disabled.
-// Also, it evaluates the expression if present and only allows access if the expression evaluates to true.
-func (o *OIDC) CreateMiddleware(protection *StaticPageProtection) (echo.MiddlewareFunc, error) {
-	providerId := protection.Provider
-	allowedGroups := protection.Groups
-
-	var expression *Expression = nil
-	if protection.Expression != "" {
-		expr, err := newExpression(protection.Expression)
+// newProviderSession builds the provider session from the token response and the verified ID token.
+// The user info is fetched from the IdP and the refresh token is stored encrypted.
+// If the idToken is nil, the ID token related fields stay empty.
+func (o *OIDC) newProviderSession(ctx context.Context, p *Provider, token *oauth2.Token, idToken *oidc.IDToken, rawIDToken string) (ProviderSession, error) {
+	ui, err := p.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		log.WithError(err).Error(ErrOIDCUserInfo.Error())
+		return ProviderSession{}, ErrOIDCUserInfo
+	}
+	var uiClaims map[string]any
+	if err := ui.Claims(&uiClaims); err != nil {
+		log.WithError(err).Error(ErrOIDCUserInfoClaims.Error())
+		return ProviderSession{}, ErrOIDCUserInfoClaims
+	}
+
+	providerSession := ProviderSession{
+		ExpiresAt: token.Expiry.Unix(),
+		UserInfo:  uiClaims,
+		IDToken:   rawIDToken,
+	}
+
+	// collect claims from id token
+	var idTokenClaims map[string]any
+	if idToken != nil {
+		if err := idToken.Claims(&idTokenClaims); err != nil {
+			log.WithError(err).Error(ErrOIDCClaims.Error())
+			return ProviderSession{}, ErrOIDCClaims
+		}
+		providerSession.Subject = idToken.Subject
+		providerSession.IDTokenClaims = idTokenClaims
+	}
+
+	// collect groups from the configured source
+	var groupsClaims map[string]any
+	switch p.cfg.GroupsClaim.Source {
+	case GroupsSourceUserInfo:
+		groupsClaims = uiClaims
+	case GroupsSourceAccessToken:
+		groupsClaims, err = p.accessTokenClaims(ctx, token.AccessToken)
+		if err != nil {
+			log.WithField("providerId", p.cfg.Id).
+				WithError(err).
+				Warn("Failed to read groups from access token, it is not a valid JWT")
+		}
+	default:
+		groupsClaims = idTokenClaims
+	}
+	if groupsClaims != nil {
+		value, _ := p.groupsClaim.lookup(groupsClaims)
+		providerSession.Groups = normalizeGroups(value)
+	}
+
+	if token.RefreshToken != "" {
+		encrypted, err := o.cipher.Encrypt(token.RefreshToken)
 		if err != nil {
-			log.WithError(err).Error("Error compiling expression")
-			return nil, err
+			log.WithError(err).Error(ErrOIDCTokenEncrypt.Error())
+			return ProviderSession{}, ErrOIDCTokenEncrypt
 		}
-		expression = expr
+		providerSession.RefreshToken = encrypted
 	}
+	encrypted, err := o.cipher.Encrypt(token.AccessToken)
+	if err != nil {
+		log.WithError(err).Error(ErrOIDCTokenEncrypt.Error())
+		return ProviderSession{}, ErrOIDCTokenEncrypt
+	}
+	providerSession.AccessToken = encrypted
+	return providerSession, nil
+}
 
+// sessionAccessToken returns the decrypted access token and its expiry from the session of the provider.
+// A token, which expires within the accessTokenLeeway, is refreshed first and the session is saved.
+func (o *OIDC) sessionAccessToken(c echo.Context, providerId string) (string, int64, error) {
 	provider, ok := o.providers[providerId]
 	if !ok {
-		errorMsg := fmt.Errorf("no OIDC provider with ID %s", providerId)
-		log.Error(errorMsg)
-		return nil, errorMsg
+		return "", 0, fmt.Errorf("no OIDC provider with ID %s", providerId)
+	}
+	sess, err := session.Get(sessionName, c)
+	if err != nil {
+		return "", 0, ErrOIDCNoSession
+	}
+	providerSessions, _ := sess.Values[providerSessionsKey].(map[string]ProviderSession)
+	providerSession, ok := providerSessions[providerId]
+	if !ok || providerSession.AccessToken == "" {
+		return "", 0, ErrOIDCNoSession
+	}
+
+	if providerSession.ExpiresWithin(accessTokenLeeway) {
+		providerSession, err = o.refreshProviderSession(c.Request().Context(), provider, providerSession)
+		if err != nil {
+			return "", 0, err
+		}
+		providerSessions[providerId] = providerSession
+		sess.Values[providerSessionsKey] = providerSessions
+		if err := sess.Save(c.Request(), c.Response()); err != nil {
+			log.WithError(err).Error("Failed to save session")
+			return "", 0, err
+		}
+	}
+
+	accessToken, err := o.cipher.Decrypt(providerSession.AccessToken)
+	if err != nil {
+		log.WithError(err).Warn("Failed to decrypt access token")
+		return "", 0, err
+	}
+	return accessToken, providerSession.ExpiresAt, nil
+}
+
+// refreshProviderSession gets new tokens from the IdP with the stored refresh token
+// and rebuilds the provider session from them.
+// When the IdP does not return a new ID token, the ID token data of the old session is kept.
+func (o *OIDC) refreshProviderSession(ctx context.Context, p *Provider, old ProviderSession) (ProviderSession, error) {
+	if old.RefreshToken == "" {
+		return ProviderSession{}, ErrOIDCNoRefreshToken
+	}
+	refreshToken, err := o.cipher.Decrypt(old.RefreshToken)
+	if err != nil {
+		log.WithError(err).Warn("Failed to decrypt refresh token")
+		return ProviderSession{}, err
+	}
+
+	// the token source refreshes the token, because the access token is missing
+	token, err := p.oauth2Config.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		log.WithField("providerId", p.cfg.Id).WithError(err).Debug("Failed to refresh token")
+		return ProviderSession{}, err
+	}
+
+	var idToken *oidc.IDToken
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if ok {
+		idToken, err = p.verifyIDToken(ctx, rawIDToken)
+		if err != nil {
+			log.WithError(err).Warn("Failed to verify refreshed ID token")
+			return ProviderSession{}, err
+		}
+	}
+
+	providerSession, err := o.newProviderSession(ctx, p, token, idToken, rawIDToken)
+	if err != nil {
+		return ProviderSession{}, err
+	}
+	if idToken == nil {
+		providerSession.Subject = old.Subject
+		providerSession.IDToken = old.IDToken
+		providerSession.IDTokenClaims = old.IDTokenClaims
+		if p.cfg.GroupsClaim.Source == GroupsSourceIDToken {
+			providerSession.Groups = old.Groups
+		}
+	}
+	return providerSession, nil
+}
+
+// CreateLogoutHandler create a logout handler for all providers.
+// When the parameter "provider" is set, only the session of this provider is removed.
+// Otherwise, the whole session is destroyed.
+// If the provider offers an end_session_endpoint, the user is redirected there for the
+// RP-initiated logout, else directly to the configured post logout redirect uri.
+// On a global logout, the first provider (ordered by id) with a session and an
+// end_session_endpoint is used.
+func (o *OIDC) CreateLogoutHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		providerId := c.Param("provider")
+		if providerId != "" {
+			if _, ok := o.providers[providerId]; !ok {
+				log.Debugf("OIDC provider %s not found", providerId)
+				return c.String(http.StatusBadRequest, "unknown OIDC provider")
+			}
+		}
+
+		sess, err := session.Get(sessionName, c)
+		if err != nil {
+			log.WithError(err).Error("Failed to get session")
+			return c.String(http.StatusInternalServerError, "failed to get session")
+		}
+
+		providerSessions, _ := sess.Values[providerSessionsKey].(map[string]ProviderSession)
+
+		var logoutProvider *Provider
+		var idTokenHint string
+		if providerId != "" {
+			// remove only the session of the provider
+			if providerSession, ok := providerSessions[providerId]; ok {
+				logoutProvider = o.providers[providerId]
+				idTokenHint = providerSession.IDToken
+				delete(providerSessions, providerId)
+			}
+		} else {
+			ids := make([]string, 0, len(providerSessions))
+			for id := range providerSessions {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				p, ok := o.providers[id]
+				if ok && p.cfg.EndSessionEndpoint != "" {
+					logoutProvider = p
+					idTokenHint = providerSessions[id].IDToken
+					break
+				}
+			}
+			// destroy the whole session
+			sess.Values = make(map[any]any)
+			sess.Options.MaxAge = -1
+		}
+
+		if err := sess.Save(c.Request(), c.Response()); err != nil {
+			log.WithError(err).Error("Failed to save session")
+			return c.String(http.StatusInternalServerError, "failed to save session")
+		}
+
+		redirectURL := o.cfg.Content.OIDC.PostLogoutRedirectUri
+		if logoutProvider != nil {
+			if endSessionURL, ok := logoutProvider.endSessionURL(idTokenHint, redirectURL); ok {
+				redirectURL = endSessionURL
+			}
+		}
+		log.WithField("providerId", providerId).Debug("User logged out")
+		return c.Redirect(http.StatusFound, redirectURL)
+	}
+}
+
+// CreateMiddleware create a middleware, which protect all following routes.
+// It checks for user auth and redirect to IdP auth url if needed or redirect to an error page.
+// A valid session of any provider of the policy is accepted. Without a session, the user is redirected
+// to the IdP or, when the policy allows multiple providers, the provider selection page is shown.
+// Requests with a bearer token are checked without session and are never redirected,
+// when one of the providers accepts bearer tokens.
+// The user must fulfill all rules of the policy (groups, expression and composed rules) to pass the auth test.
+func (o *OIDC) CreateMiddleware(policy *AccessPolicy) (echo.MiddlewareFunc, error) {
+	var providers, bearerProviders []*Provider
+	var credentials []credentialProvider
+	for _, providerId := range policy.Providers() {
+		if credential, ok := o.credentials[providerId]; ok {
+			credentials = append(credentials, credential)
+			continue
+		}
+		provider, ok := o.providers[providerId]
+		if !ok {
+			errorMsg := fmt.Errorf("no OIDC provider with ID %s", providerId)
+			log.Error(errorMsg)
+			return nil, errorMsg
+		}
+		providers = append(providers, provider)
+		if provider.bearer != nil {
+			bearerProviders = append(bearerProviders, provider)
+		}
 	}
-	oauth2Config := provider.oauth2Config
 
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
+			// static pages deny the networks before the share links, the forward auth only uses this check
+			switch policy.checkNetwork(net.ParseIP(c.RealIP())) {
+			case networkDenied:
+				return c.String(http.StatusForbidden, "Access from your network is not allowed.")
+			case networkBypass:
+				return next(c)
+			}
+
+			for _, credential := range credentials {
+				accessContext, err := credential.authenticate(c.Request())
+				if err != nil {
+					log.WithError(err).Debug("Credentials not accepted")
+					return credentialsRequired(c, credentials)
+				}
+				if accessContext != nil {
+					return o.authorize(c, policy, accessContext, next)
+				}
+			}
+			if token, ok := bearerToken(c.Request()); ok && len(bearerProviders) > 0 {
+				return o.authorizeBearer(c, policy, bearerProviders, token, next)
+			}
+			// only machine accounts can access the page
+			if len(providers) == 0 {
+				return credentialsRequired(c, credentials)
+			}
+
 			sess, err := session.Get(sessionName, c)
 			if err != nil {
-				return redirectForAuth(oauth2Config, c)
+				return o.requireLogin(providers, c)
 			}
 
 			providerSessions, ok := sess.Values[providerSessionsKey].(map[string]ProviderSession)
 			if !ok || providerSessions == nil {
-				return redirectForAuth(oauth2Config, c)
+				return o.requireLogin(providers, c)
 			}
 
-			providerSession, ok := providerSessions[providerId]
+			authenticated := false
+			for _, provider := range providers {
+				providerId := provider.cfg.Id
+				providerSession, ok := providerSessions[providerId]
+				if !ok {
+					continue
+				}
 
-			if !ok || (providerSession.ExpiresAt > 0 && providerSession.ExpiresAt < time.Now().Unix()) {
-				return redirectForAuth(oauth2Config, c)
-			}
+				// try a silent renewal before sending the user to the IdP
+				if providerSession.Expired() {
+					providerSession, err = o.refreshProviderSession(c.Request().Context(), provider, providerSession)
+					if err != nil {
+						continue
+					}
+					providerSessions[providerId] = providerSession
+					sess.Values[providerSessionsKey] = providerSessions
+					if err := sess.Save(c.Request(), c.Response()); err != nil {
+						log.WithError(err).Error("Failed to save session")
+						return c.String(http.StatusInternalServerError, "failed to save session")
+					}
+				}
+				authenticated = true
 
-			if expression != nil {
-				result, err := expression.Eval(providerSession.UserInfo)
+				accessContext := newAccessContext(providerId, providerSession)
+				accessContext.Request = newRequestInfo(c, o.cfg.Settings.Expression.RequestHeaders)
+				result, err := policy.Evaluate(accessContext)
 				if err != nil {
-					log.WithError(err).Error("Error evaluating expression")
-					return c.String(http.StatusInternalServerError, "error evaluating access expression")
+					return policyErrorResponse(c, err)
 				}
-				if !result {
-					return c.String(http.StatusForbidden, "You do not have the required permissions to access this resource.")
+				if result {
+					c.Set(accessContextKey, accessContext)
+					return next(c)
 				}
 			}
 
-			if !checkHasOneGroup(allowedGroups, providerSession.Groups) {
-				return c.String(http.StatusForbidden, "You do not have the required permissions to access this resource.")
+			if !authenticated {
+				return o.requireLogin(providers, c)
 			}
-
-			return next(c)
+			return c.String(http.StatusForbidden, "You do not have the required permissions to access this resource.")
 		}
 	}, nil
 }
 
-// redirectForAuth redirects the user to the OIDC provider auth url and saves the state in the session.
-// The state is used to prevent CSRF attacks.
-func redirectForAuth(oauth2Config oauth2.Config, c echo.Context) error {
-	log.Debugf("Redirecting to OIDC provider for auth: %s", oauth2Config.ClientID)
+// authorizeBearer checks the bearer token with the providers and evaluates the policy for the first valid token.
+// Invalid tokens are answered with 401 and denied access with 403.
+func (o *OIDC) authorizeBearer(c echo.Context, policy *AccessPolicy, providers []*Provider, token string, next echo.HandlerFunc) error {
+	for _, provider := range providers {
+		claims, err := provider.bearer.verify(c.Request().Context(), token)
+		if err != nil {
+			log.WithField("providerId", provider.cfg.Id).WithError(err).Debug("Bearer token not accepted")
+			continue
+		}
 
-	sess, err := session.Get(sessionName, c)
+		return o.authorize(c, policy, newBearerAccessContext(provider, claims), next)
+	}
+
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+	return c.String(http.StatusUnauthorized, "invalid bearer token")
+}
+
+// authorize evaluates the policy for the authenticated machine account or bearer token.
+// Denied access is answered with 403.
+func (o *OIDC) authorize(c echo.Context, policy *AccessPolicy, accessContext *AccessContext, next echo.HandlerFunc) error {
+	accessContext.Request = newRequestInfo(c, o.cfg.Settings.Expression.RequestHeaders)
+	result, err := policy.Evaluate(accessContext)
 	if err != nil {
-		log.WithError(err).Error("Session cannot be retrieved")
-		return c.String(http.StatusInternalServerError, "Session cannot be retrieved")
+		return policyErrorResponse(c, err)
+	}
+	if !result {
+		return c.String(http.StatusForbidden, "You do not have the required permissions to access this resource.")
+	}
+	c.Set(accessContextKey, accessContext)
+	return next(c)
+}
+
+// credentialsRequired answers with 401 and the challenges of the credential providers.
+func credentialsRequired(c echo.Context, credentials []credentialProvider) error {
+	for _, credential := range credentials {
+		credential.challenge(c.Response().Header())
+	}
+	return c.String(http.StatusUnauthorized, "valid credentials are required")
+}
+
+// policyErrorResponse answers the request, when the policy can not be evaluated.
+func policyErrorResponse(c echo.Context, err error) error {
+	if errors.Is(err, ErrExpressionTimeout) || errors.Is(err, ErrExpressionLimit) {
+		return c.String(http.StatusServiceUnavailable, "access expression exceeded its limits")
+	}
+	log.WithError(err).Error("Error evaluating expression")
+	return c.String(http.StatusInternalServerError, "error evaluating access expression")
+}
+
+// requireLogin sends the user to the login of the only provider or shows the provider selection page.
+// Requests, which are no top-level navigation (e.g. fetch calls or image loads), get a 401 with the login urls,
+// so the login does not redirect back to them.
+// Forward auth requests always get a 401 with absolute login urls, which return to the forwarded url.
+func (o *OIDC) requireLogin(providers []*Provider, c echo.Context) error {
+	if forwardedURL, ok := c.Get(forwardedURLKey).(string); ok {
+		return o.loginRequiredResponse(providers, c, forwardedURL, o.baseUrl)
 	}
 
-	b := make([]byte, 16)
-	_, err = rand.Read(b)
+	target := c.Request().URL.RequestURI()
+	if !isNavigationRequest(c.Request()) {
+		// the login redirects to the referring page instead of the requested asset
+		if referer := c.Request().Referer(); o.isAllowedRedirect(referer) {
+			target = referer
+		}
+		return o.loginRequiredResponse(providers, c, target, "")
+	}
+	if len(providers) == 1 {
+		return o.redirectForAuth(providers[0], c, target)
+	}
+	return renderProviderChooser(c, providers, target)
+}
+
+// loginRequiredResponse answers with 401 and the login urls as JSON.
+// The login url is also sent in the X-Auth-Request-Login-Url header.
+// The urlPrefix is prepended to the login urls to make them absolute.
+func (o *OIDC) loginRequiredResponse(providers []*Provider, c echo.Context, target, urlPrefix string) error {
+	type loginProvider struct {
+		Id          string `json:"id"`
+		DisplayName string `json:"display_name"`
+		LoginURL    string `json:"login_url"`
+	}
+	response := struct {
+		Error     string          `json:"error"`
+		LoginURL  string          `json:"login_url"`
+		Providers []loginProvider `json:"providers"`
+	}{
+		Error:    "login_required",
+		LoginURL: urlPrefix + selectProviderURL(providers, target),
+	}
+	for _, provider := range providers {
+		response.Providers = append(response.Providers, loginProvider{
+			Id:          provider.cfg.Id,
+			DisplayName: provider.cfg.GetDisplayName(),
+			LoginURL:    urlPrefix + loginURL(provider, target),
+		})
+	}
+	if len(providers) == 1 {
+		response.LoginURL = response.Providers[0].LoginURL
+	}
+
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	c.Response().Header().Set(HeaderAuthRequestLoginUrl, response.LoginURL)
+	return c.JSON(http.StatusUnauthorized, response)
+}
+
+// CreateSelectProviderHandler creates a handler, which shows the provider selection page
+// for the providers of the provider query parameters or for all providers.
+// After the login, the user is redirected to the redirect query parameter, if it is an allowed target.
+func (o *OIDC) CreateSelectProviderHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var providers []*Provider
+		for _, providerId := range c.QueryParams()["provider"] {
+			if provider, ok := o.providers[providerId]; ok {
+				providers = append(providers, provider)
+			}
+		}
+		if len(providers) == 0 {
+			for _, providerId := range o.providers.sortedIds() {
+				providers = append(providers, o.providers[providerId])
+			}
+		}
+
+		target := c.QueryParam("redirect")
+		if !o.isAllowedRedirect(target) {
+			target = "/"
+		}
+		return renderProviderChooser(c, providers, target)
+	}
+}
+
+// CreateLoginHandler creates a handler, which starts the login at the provider of the path.
+// After the login, the user is redirected to the redirect query parameter, if it is an allowed target.
+func (o *OIDC) CreateLoginHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		providerId := c.Param("provider")
+		provider, ok := o.providers[providerId]
+		if !ok {
+			return c.String(http.StatusBadRequest, "unknown OIDC provider")
+		}
+
+		target := c.QueryParam("redirect")
+		if !o.isAllowedRedirect(target) {
+			target = "/"
+		}
+		return o.redirectForAuth(provider, c, target)
+	}
+}
+
+// redirectForAuth redirects the user to the OIDC provider auth url and stores a new auth transaction
+// for the state in its own session.
+// The state is used to prevent CSRF attacks, the nonce binds the ID token to this auth request.
+// When PKCE is enabled for the provider, a code verifier is stored in the transaction
+// and the S256 challenge is sent with the auth request.
+// After the login, the user is redirected to the target.
+func (o *OIDC) redirectForAuth(provider *Provider, c echo.Context, target string) error {
+	oauth2Config := provider.oauth2Config
+	log.Debugf("Redirecting to OIDC provider for auth: %s", oauth2Config.ClientID)
+
+	state, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	nonce, err := randomString(16)
 	if err != nil {
 		return err
 	}
-	state := base64.URLEncoding.EncodeToString(b)
 
-	sess.Values["state"] = state
-	sess.Values["original_path"] = c.Request().URL.Path
+	transaction := AuthTransaction{
+		Provider:  provider.cfg.Id,
+		TargetURL: target,
+		Nonce:     nonce,
+		CreatedAt: time.Now().Unix(),
+	}
+
+	authOpts := append([]oauth2.AuthCodeOption{oidc.Nonce(nonce)}, provider.authOptions...)
+	if provider.cfg.PKCEEnabled() {
+		transaction.Verifier = oauth2.GenerateVerifier()
+		authOpts = append(authOpts, oauth2.S256ChallengeOption(transaction.Verifier))
+	}
 
-	if err := sess.Save(c.Request(), c.Response()); err != nil {
+	if err := saveAuthTransaction(c, state, transaction, o.cfg.Content.OIDC.TransactionTTL); err != nil {
+		log.WithError(err).Error("Auth transaction cannot be saved")
 		return c.String(http.StatusInternalServerError, "cannot save session")
 	}
 
-	authURL := oauth2Config.AuthCodeURL(state)
+	authURL := oauth2Config.AuthCodeURL(state, authOpts...)
 	return c.Redirect(http.StatusFound, authURL)
 }
 
-// checkHasOneGroup checks if at least one of the present groups is in the allowed groups.
-// If the allowed list is empty, then it always returns true to disable the group check.
-func checkHasOneGroup(allowed, present []string) bool {
-	if len(allowed) == 0 {
-		return true
-	}
-	for _, presentGroup := range present {
-		for _, allowedGroup := range allowed {
-			if presentGroup == allowedGroup {
-				return true
-			}
-		}
+// randomString creates a url safe random string from n random bytes.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
 	}
-	return false
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
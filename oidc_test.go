@@ -1,21 +1,31 @@
 package main
 
 import (
+	"net/url"
 	"testing"
 
 	"github.com/go-playground/assert/v2"
+	"golang.org/x/oauth2"
 )
 
-func TestCheckHasOneGroup(t *testing.T) {
-	a1 := []string{"group1"}
-	a2 := []string{"group2", "group3"}
+func TestEndSessionURL(t *testing.T) {
+	p := &Provider{
+		cfg:          ProviderConfig{},
+		oauth2Config: oauth2.Config{ClientID: "client"},
+	}
+	_, ok := p.endSessionURL("token", "http://localhost/")
+	assert.Equal(t, ok, false)
 
-	assert.Equal(t, checkHasOneGroup(a1, a2), false)
-	assert.Equal(t, checkHasOneGroup(a1, []string{}), false)
-	assert.Equal(t, checkHasOneGroup(a1, []string{"group"}), false)
-	assert.Equal(t, checkHasOneGroup(a1, []string{"group1"}), true)
-	assert.Equal(t, checkHasOneGroup(a1, []string{"group1", "foo"}), true)
-	assert.Equal(t, checkHasOneGroup(a2, []string{"group1", "group3"}), true)
-	assert.Equal(t, checkHasOneGroup(a2, []string{"group2", "group3"}), true)
-	assert.Equal(t, checkHasOneGroup(a2, []string{"group1"}), false)
+	p.cfg.EndSessionEndpoint = "http://idp/logout?foo=bar"
+	u, ok := p.endSessionURL("token", "http://localhost/")
+	assert.Equal(t, ok, true)
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := parsed.Query()
+	assert.Equal(t, q.Get("foo"), "bar")
+	assert.Equal(t, q.Get("id_token_hint"), "token")
+	assert.Equal(t, q.Get("client_id"), "client")
+	assert.Equal(t, q.Get("post_logout_redirect_uri"), "http://localhost/")
 }
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrPolicyUnknown          = errors.New("unknown access policy")
+	ErrPolicyCycle            = errors.New("access policies reference each other in a cycle")
+	ErrPolicyDuplicate        = errors.New("access policy is defined more than once")
+	ErrPolicyProviderConflict = errors.New("access policy references different providers")
+	ErrPolicyNestedProvider   = errors.New("nested access rules can not define providers")
+	ErrPolicyNoProvider       = errors.New("access policy has no provider")
+	ErrPolicyNestedNetwork    = errors.New("nested access rules can not define network rules")
+)
+
+// networkAccess is the result of the network rules for a client IP.
+type networkAccess int
+
+const (
+	// the user must be authenticated and authorized
+	networkAuthenticate networkAccess = iota
+	networkDenied
+	// the request is allowed without login
+	networkBypass
+)
+
+// networkRule restricts the client IPs of a policy.
+type networkRule struct {
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	bypass []*net.IPNet
+}
+
+// newNetworkRule parses the network rules of the protection.
+func newNetworkRule(protection *StaticPageProtection) (networkRule, error) {
+	var rule networkRule
+	var err error
+	if rule.allow, err = parseCIDRs(protection.AllowCIDRs); err != nil {
+		return rule, err
+	}
+	if rule.deny, err = parseCIDRs(protection.DenyCIDRs); err != nil {
+		return rule, err
+	}
+	rule.bypass, err = parseCIDRs(protection.BypassAuthFrom)
+	return rule, err
+}
+
+func (r networkRule) empty() bool {
+	return len(r.allow) == 0 && len(r.deny) == 0 && len(r.bypass) == 0
+}
+
+// AccessPolicy is the compiled form of a StaticPageProtection.
+// All rules of a policy must be fulfilled to grant access.
+type AccessPolicy struct {
+	// id of the named policy, empty for inline policies
+	name string
+	// ids of the providers, a session of any of them is accepted
+	providers  []string
+	network    networkRule
+	groups     groupRule
+	expression *Expression
+	// referenced named policy
+	policy *AccessPolicy
+	allOf  []*AccessPolicy
+	anyOf  []*AccessPolicy
+	not    *AccessPolicy
+}
+
+// Providers returns the ids of the providers to authenticate with in the configured order.
+// If the policy itself has no providers, these are the providers of the referenced policies.
+func (p *AccessPolicy) Providers() []string {
+	return p.providers
+}
+
+// checkNetwork checks the client IP against the network rules of the policy and of the referenced policies.
+// Denied networks win over the bypass of the authentication.
+func (p *AccessPolicy) checkNetwork(ip net.IP) networkAccess {
+	bypass := false
+	for policy := p; policy != nil; policy = policy.policy {
+		rule := policy.network
+		if ipInCIDRs(ip, rule.deny) || (len(rule.allow) > 0 && !ipInCIDRs(ip, rule.allow)) {
+			return networkDenied
+		}
+		bypass = bypass || ipInCIDRs(ip, rule.bypass)
+	}
+	if bypass {
+		return networkBypass
+	}
+	return networkAuthenticate
+}
+
+// hasNetworkRules reports if the policy or one of the referenced policies has network rules.
+func (p *AccessPolicy) hasNetworkRules() bool {
+	for policy := p; policy != nil; policy = policy.policy {
+		if !policy.network.empty() {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate checks if the access context fulfills all rules of the policy.
+// The expression is evaluated first, then the groups, the referenced policy and the composed rules.
+// It returns an error, when an expression can not be evaluated.
+func (p *AccessPolicy) Evaluate(ctx *AccessContext) (bool, error) {
+	if p.expression != nil {
+		result, err := p.expression.EvalContext(ctx)
+		if err != nil || !result {
+			return false, err
+		}
+	}
+
+	if !p.groups.check(ctx.Groups) {
+		return false, nil
+	}
+
+	if p.policy != nil {
+		result, err := p.policy.Evaluate(ctx)
+		if err != nil || !result {
+			return false, err
+		}
+	}
+
+	for _, rule := range p.allOf {
+		result, err := rule.Evaluate(ctx)
+		if err != nil || !result {
+			return false, err
+		}
+	}
+
+	if len(p.anyOf) > 0 {
+		anyResult := false
+		for _, rule := range p.anyOf {
+			result, err := rule.Evaluate(ctx)
+			if err != nil {
+				return false, err
+			}
+			if result {
+				anyResult = true
+				break
+			}
+		}
+		if !anyResult {
+			return false, nil
+		}
+	}
+
+	if p.not != nil {
+		result, err := p.not.Evaluate(ctx)
+		if err != nil || result {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// AccessPolicies contains the compiled named policies by id.
+type AccessPolicies map[string]*AccessPolicy
+
+// compilePolicies compiles all named policies once, so they can be shared between the pages.
+// Named policies can reference each other, but not in a cycle.
+func compilePolicies(cfgs []NamedPolicy) (AccessPolicies, error) {
+	byId := make(map[string]*StaticPageProtection, len(cfgs))
+	for i := range cfgs {
+		if _, ok := byId[cfgs[i].Id]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrPolicyDuplicate, cfgs[i].Id)
+		}
+		byId[cfgs[i].Id] = &cfgs[i].StaticPageProtection
+	}
+
+	c := policyCompiler{
+		configs:  byId,
+		policies: make(AccessPolicies, len(cfgs)),
+		visiting: make(map[string]bool),
+	}
+	for _, cfg := range cfgs {
+		if _, err := c.named(cfg.Id); err != nil {
+			log.WithField("policy", cfg.Id).WithError(err).Error("Error compiling access policy")
+			return nil, err
+		}
+	}
+	return c.policies, nil
+}
+
+// Compile compiles the protection of a page, which can reference the named policies.
+// The resulting policy must have at least one provider.
+func (ps AccessPolicies) Compile(protection *StaticPageProtection) (*AccessPolicy, error) {
+	c := policyCompiler{policies: ps}
+	policy, err := c.compile(protection, "", false)
+	if err != nil {
+		return nil, err
+	}
+	if len(policy.Providers()) == 0 {
+		return nil, ErrPolicyNoProvider
+	}
+	return policy, nil
+}
+
+// policyCompiler keeps the state while compiling the policies.
+type policyCompiler struct {
+	// configs of the named policies, only required while compiling named policies
+	configs map[string]*StaticPageProtection
+	// already compiled named policies
+	policies AccessPolicies
+	// named policies in the current reference chain to detect cycles
+	visiting map[string]bool
+}
+
+// named returns the compiled named policy and compiles it, if not done yet.
+func (c *policyCompiler) named(id string) (*AccessPolicy, error) {
+	if policy, ok := c.policies[id]; ok {
+		return policy, nil
+	}
+	cfg, ok := c.configs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrPolicyUnknown, id)
+	}
+	if c.visiting[id] {
+		return nil, fmt.Errorf("%w: %s", ErrPolicyCycle, id)
+	}
+	c.visiting[id] = true
+	defer delete(c.visiting, id)
+
+	policy, err := c.compile(cfg, id, false)
+	if err != nil {
+		return nil, err
+	}
+	c.policies[id] = policy
+	return policy, nil
+}
+
+// compile compiles the protection and all nested rules.
+// Nested rules are evaluated against the user of the outer policy, so they can not define providers.
+// Referenced policies can only define the same providers as the outer policy.
+func (c *policyCompiler) compile(protection *StaticPageProtection, name string, nested bool) (*AccessPolicy, error) {
+	providers := protectionProviders(protection)
+	if nested && len(providers) > 0 {
+		return nil, ErrPolicyNestedProvider
+	}
+
+	network, err := newNetworkRule(protection)
+	if err != nil {
+		return nil, err
+	}
+	if nested && !network.empty() {
+		return nil, ErrPolicyNestedNetwork
+	}
+
+	policy := &AccessPolicy{
+		name:      name,
+		providers: providers,
+		network:   network,
+	}
+	groups, err := newGroupRule(protection.Groups, protection.DenyGroups, protection.RequireAll)
+	if err != nil {
+		return nil, err
+	}
+	policy.groups = groups
+	// take over the providers of a referenced or nested policy
+	mergeProvider := func(other *AccessPolicy, reference string) error {
+		if len(other.providers) == 0 || sameProviders(other.providers, policy.providers) {
+			return nil
+		}
+		if len(policy.providers) > 0 {
+			return fmt.Errorf("%w: %s", ErrPolicyProviderConflict, reference)
+		}
+		policy.providers = other.providers
+		return nil
+	}
+	// compile a list of nested rules
+	compileRules := func(protections []StaticPageProtection) ([]*AccessPolicy, error) {
+		var rules []*AccessPolicy
+		for i := range protections {
+			rule, err := c.compile(&protections[i], "", true)
+			if err != nil {
+				return nil, err
+			}
+			if err := mergeProvider(rule, "nested rule"); err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+		return rules, nil
+	}
+
+	if protection.Expression != "" {
+		expression, err := newExpressionWithLimits(protection.Expression, protection.ExpressionLimits())
+		if err != nil {
+			return nil, err
+		}
+		policy.expression = expression
+	}
+
+	if protection.Policy != "" {
+		referenced, err := c.named(protection.Policy)
+		if err != nil {
+			return nil, err
+		}
+		if err := mergeProvider(referenced, protection.Policy); err != nil {
+			return nil, err
+		}
+		// the network rules are only checked for the policy of the page and its referenced policies
+		if nested && referenced.hasNetworkRules() {
+			return nil, fmt.Errorf("%w: %s", ErrPolicyNestedNetwork, protection.Policy)
+		}
+		policy.policy = referenced
+	}
+
+	if policy.allOf, err = compileRules(protection.AllOf); err != nil {
+		return nil, err
+	}
+	if policy.anyOf, err = compileRules(protection.AnyOf); err != nil {
+		return nil, err
+	}
+	if protection.Not != nil {
+		rule, err := c.compile(protection.Not, "", true)
+		if err != nil {
+			return nil, err
+		}
+		if err := mergeProvider(rule, "nested rule"); err != nil {
+			return nil, err
+		}
+		policy.not = rule
+	}
+	return policy, nil
+}
+
+// protectionProviders returns the provider and the providers of the protection without duplicates.
+func protectionProviders(protection *StaticPageProtection) []string {
+	var providers []string
+	for _, id := range append([]string{protection.Provider}, protection.Providers...) {
+		if id != "" && !slices.Contains(providers, id) {
+			providers = append(providers, id)
+		}
+	}
+	return providers
+}
+
+// sameProviders checks if both lists contain the same providers, regardless of the order.
+func sameProviders(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, id := range a {
+		if !slices.Contains(b, id) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestPolicyEvaluate(t *testing.T) {
+	policies, err := compilePolicies([]NamedPolicy{
+		{Id: "staff", StaticPageProtection: StaticPageProtection{Provider: "idp", Groups: []string{"staff"}}},
+		{Id: "admins", StaticPageProtection: StaticPageProtection{Expression: `contains(groups, "admins")`}},
+		{Id: "staffOrAdmins", StaticPageProtection: StaticPageProtection{
+			AnyOf: []StaticPageProtection{{Policy: "staff"}, {Policy: "admins"}},
+		}},
+		{Id: "staffNoContractor", StaticPageProtection: StaticPageProtection{
+			AllOf: []StaticPageProtection{{Policy: "staff"}},
+			Not:   &StaticPageProtection{Expression: `user.type == "contractor"`},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile policies: %v", err)
+	}
+
+	tests := []struct {
+		policy   string
+		groups   []string
+		userType string
+		expected bool
+	}{
+		{"staff", []string{"staff"}, "", true},
+		{"staff", []string{"admins"}, "", false},
+		{"staffOrAdmins", []string{"admins"}, "", true},
+		{"staffOrAdmins", []string{"staff"}, "", true},
+		{"staffOrAdmins", []string{"guests"}, "", false},
+		{"staffNoContractor", []string{"staff"}, "employee", true},
+		{"staffNoContractor", []string{"staff"}, "contractor", false},
+		{"staffNoContractor", []string{"admins"}, "employee", false},
+	}
+	for _, test := range tests {
+		policy, err := policies.Compile(&StaticPageProtection{Policy: test.policy})
+		if err != nil {
+			t.Fatalf("failed to compile page protection: %v", err)
+		}
+		if !slices.Equal(policy.Providers(), []string{"idp"}) {
+			t.Errorf("expected provider idp for %s, got %v", test.policy, policy.Providers())
+		}
+		ctx := &AccessContext{Groups: test.groups, UserInfo: map[string]any{"type": test.userType}}
+		result, err := policy.Evaluate(ctx)
+		if err != nil {
+			t.Errorf("failed to evaluate %s: %v", test.policy, err)
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("unexpected result for %s with %v/%s: got %v, want %v", test.policy, test.groups, test.userType, result, test.expected)
+		}
+	}
+}
+
+func TestPolicySharedBetweenPages(t *testing.T) {
+	policies, err := compilePolicies([]NamedPolicy{
+		{Id: "staff", StaticPageProtection: StaticPageProtection{Provider: "idp", Groups: []string{"staff"}}},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile policies: %v", err)
+	}
+	page1, _ := policies.Compile(&StaticPageProtection{Policy: "staff"})
+	page2, _ := policies.Compile(&StaticPageProtection{Policy: "staff", Groups: []string{"admins"}})
+	if page1.policy != page2.policy || page1.policy != policies["staff"] {
+		t.Errorf("expected the named policy to be compiled once and shared")
+	}
+}
+
+func TestPolicyProviders(t *testing.T) {
+	policies, err := compilePolicies([]NamedPolicy{
+		{Id: "partners", StaticPageProtection: StaticPageProtection{Providers: []string{"entra", "keycloak"}}},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile policies: %v", err)
+	}
+
+	tests := []struct {
+		protection StaticPageProtection
+		expected   []string
+	}{
+		{StaticPageProtection{Provider: "entra", Providers: []string{"keycloak", "entra"}}, []string{"entra", "keycloak"}},
+		{StaticPageProtection{Policy: "partners"}, []string{"entra", "keycloak"}},
+		{StaticPageProtection{Providers: []string{"keycloak", "entra"}, Policy: "partners"}, []string{"keycloak", "entra"}},
+	}
+	for _, test := range tests {
+		policy, err := policies.Compile(&test.protection)
+		if err != nil {
+			t.Errorf("failed to compile %+v: %v", test.protection, err)
+			continue
+		}
+		if !slices.Equal(policy.Providers(), test.expected) {
+			t.Errorf("unexpected providers for %+v: got %v, want %v", test.protection, policy.Providers(), test.expected)
+		}
+	}
+
+	_, err = policies.Compile(&StaticPageProtection{Provider: "entra", Policy: "partners"})
+	if !errors.Is(err, ErrPolicyProviderConflict) {
+		t.Errorf("expected error %v, got %v", ErrPolicyProviderConflict, err)
+	}
+}
+
+func TestPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		policies    []NamedPolicy
+		protection  StaticPageProtection
+		expectedErr error
+	}{
+		{
+			name:        "unknown",
+			protection:  StaticPageProtection{Provider: "idp", Policy: "missing"},
+			expectedErr: ErrPolicyUnknown,
+		},
+		{
+			name: "duplicate",
+			policies: []NamedPolicy{
+				{Id: "a", StaticPageProtection: StaticPageProtection{Provider: "idp"}},
+				{Id: "a", StaticPageProtection: StaticPageProtection{Provider: "idp"}},
+			},
+			expectedErr: ErrPolicyDuplicate,
+		},
+		{
+			name: "cycle",
+			policies: []NamedPolicy{
+				{Id: "a", StaticPageProtection: StaticPageProtection{Policy: "b"}},
+				{Id: "b", StaticPageProtection: StaticPageProtection{AnyOf: []StaticPageProtection{{Policy: "a"}}}},
+			},
+			expectedErr: ErrPolicyCycle,
+		},
+		{
+			name: "provider conflict",
+			policies: []NamedPolicy{
+				{Id: "a", StaticPageProtection: StaticPageProtection{Provider: "idp1"}},
+			},
+			protection:  StaticPageProtection{Provider: "idp2", Policy: "a"},
+			expectedErr: ErrPolicyProviderConflict,
+		},
+		{
+			name:        "nested provider",
+			protection:  StaticPageProtection{Provider: "idp", Not: &StaticPageProtection{Provider: "idp"}},
+			expectedErr: ErrPolicyNestedProvider,
+		},
+		{
+			name:        "no provider",
+			protection:  StaticPageProtection{Groups: []string{"staff"}},
+			expectedErr: ErrPolicyNoProvider,
+		},
+		{
+			name:        "nested network rule",
+			protection:  StaticPageProtection{Provider: "idp", AnyOf: []StaticPageProtection{{AllowCIDRs: []string{"10.0.0.0/8"}}}},
+			expectedErr: ErrPolicyNestedNetwork,
+		},
+		{
+			name: "nested policy with network rule",
+			policies: []NamedPolicy{
+				{Id: "office", StaticPageProtection: StaticPageProtection{BypassAuthFrom: []string{"10.0.0.0/8"}}},
+			},
+			protection:  StaticPageProtection{Provider: "idp", AnyOf: []StaticPageProtection{{Policy: "office"}}},
+			expectedErr: ErrPolicyNestedNetwork,
+		},
+		{
+			name:        "invalid CIDR",
+			protection:  StaticPageProtection{Provider: "idp", DenyCIDRs: []string{"10.0.0.0/99"}},
+			expectedErr: nil,
+		},
+		{
+			name:        "invalid expression",
+			protection:  StaticPageProtection{Provider: "idp", AllOf: []StaticPageProtection{{Expression: "user."}}},
+			expectedErr: nil,
+		},
+	}
+	for _, test := range tests {
+		policies, err := compilePolicies(test.policies)
+		if err == nil {
+			_, err = policies.Compile(&test.protection)
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+			continue
+		}
+		if test.expectedErr != nil && !errors.Is(err, test.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.expectedErr, err)
+		}
+	}
+}
+
+func TestPolicyCheckNetwork(t *testing.T) {
+	policies, err := compilePolicies([]NamedPolicy{
+		{Id: "office", StaticPageProtection: StaticPageProtection{
+			BypassAuthFrom: []string{"10.1.0.0/16"},
+			DenyCIDRs:      []string{"10.1.99.0/24"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := policies.Compile(&StaticPageProtection{
+		Provider:   "idp",
+		Policy:     "office",
+		AllowCIDRs: []string{"10.0.0.0/8", "2001:db8::/32"},
+		DenyCIDRs:  []string{"10.2.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip       string
+		expected networkAccess
+	}{
+		{"10.1.2.3", networkBypass},
+		{"10.3.0.1", networkAuthenticate},
+		{"2001:db8::1", networkAuthenticate},
+		{"10.2.0.1", networkDenied},
+		{"10.1.99.5", networkDenied},
+		{"192.168.0.1", networkDenied},
+		{"no-ip", networkDenied},
+	}
+	for _, test := range tests {
+		if result := policy.checkNetwork(net.ParseIP(test.ip)); result != test.expected {
+			t.Errorf("unexpected network access for %s: got %d, want %d", test.ip, result, test.expected)
+		}
+	}
+
+	// without network rules all IPs must authenticate
+	policy, err = policies.Compile(&StaticPageProtection{Provider: "idp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := policy.checkNetwork(net.ParseIP("192.168.0.1")); result != networkAuthenticate {
+		t.Errorf("unexpected network access without rules: %d", result)
+	}
+}
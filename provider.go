@@ -6,7 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"net/url"
+	"slices"
+	"sort"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
@@ -29,15 +33,43 @@ func newProviders(cfg []OIDCProvider, baseUrl string) (Providers, error) {
 	return p, nil
 }
 
+// sortedIds returns the ids of all providers in alphabetical order.
+func (p Providers) sortedIds() []string {
+	return slices.Sorted(maps.Keys(p))
+}
+
 type Provider struct {
 	provider     *oidc.Provider
 	oauth2Config oauth2.Config
 	cfg          ProviderConfig
+	// additional options for every auth request
+	authOptions []oauth2.AuthCodeOption
+	// path to the groups in the claims of the groups claim source
+	groupsClaim claimPath
+	// verifies bearer tokens, nil when bearer tokens are disabled
+	bearer *bearerVerifier
+}
+
+const (
+	GroupsSourceIDToken     = "id_token"
+	GroupsSourceUserInfo    = "userinfo"
+	GroupsSourceAccessToken = "access_token"
+)
+
+// defaultScopes are requested, when no scopes are configured for the provider
+var defaultScopes = []string{oidc.ScopeOpenID, "profile", "email", "groups"}
+
+// reservedAuthParams are set by the auth flow itself and can not be overwritten by extra auth params
+var reservedAuthParams = []string{
+	"client_id", "redirect_uri", "response_type", "scope", "state", "nonce",
+	"code_challenge", "code_challenge_method", "response_mode",
 }
 
 type ProviderConfig struct {
 	OIDCProvider
-	IssuerUrl string `json:"issuer"`
+	IssuerUrl             string `json:"issuer"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
 }
 
 // newProvider creates the internal oidc provider.
@@ -47,7 +79,22 @@ type ProviderConfig struct {
 func newProvider(cfg OIDCProvider, baseUrl string) (*Provider, error) {
 	p := new(Provider)
 	p.cfg = ProviderConfig{OIDCProvider: cfg}
-	err := p.cfg.resolveFromIdP()
+	if p.cfg.GroupsClaim.Path == "" {
+		p.cfg.GroupsClaim.Path = "groups"
+	}
+	if p.cfg.GroupsClaim.Source == "" {
+		p.cfg.GroupsClaim.Source = GroupsSourceIDToken
+	}
+	groupsClaim, err := parseClaimPath(p.cfg.GroupsClaim.Path)
+	if err != nil {
+		log.WithField("providerId", p.cfg.Id).
+			WithError(err).
+			Error("Invalid groups claim path.")
+		return nil, err
+	}
+	p.groupsClaim = groupsClaim
+
+	err = p.cfg.resolveFromIdP()
 	if err != nil {
 		return nil, err
 	}
@@ -65,12 +112,105 @@ func newProvider(cfg OIDCProvider, baseUrl string) (*Provider, error) {
 		ClientSecret: p.cfg.ClientSecret,
 		RedirectURL:  fmt.Sprintf("%s/auth/%s/callback", baseUrl, p.cfg.Id),
 		Endpoint:     p.provider.Endpoint(),
-		Scopes:       []string{oidc.ScopeOpenID, "profile", "email", "groups"},
+		Scopes:       buildScopes(p.cfg.OIDCProvider),
+	}
+	p.authOptions = buildAuthOptions(p.cfg.OIDCProvider)
+	if p.cfg.BearerTokens.Enabled {
+		p.bearer, err = newBearerVerifier(p)
+		if err != nil {
+			log.WithField("providerId", p.cfg.Id).
+				WithError(err).
+				Error("Failed to create bearer token verifier.")
+			return nil, err
+		}
 	}
 
 	return p, nil
 }
 
+// buildScopes returns the configured scopes or the default scopes.
+// The openid scope is always included and offline_access is added, when enabled.
+func buildScopes(cfg OIDCProvider) []string {
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+	if !slices.Contains(scopes, oidc.ScopeOpenID) {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
+	if cfg.OfflineAccess && !slices.Contains(scopes, oidc.ScopeOfflineAccess) {
+		scopes = append(slices.Clone(scopes), oidc.ScopeOfflineAccess)
+	}
+	return scopes
+}
+
+// buildAuthOptions converts the extra auth params and the response mode into options for the auth request.
+// Reserved parameters of the auth flow are skipped with a warning.
+func buildAuthOptions(cfg OIDCProvider) []oauth2.AuthCodeOption {
+	keys := make([]string, 0, len(cfg.ExtraAuthParams))
+	for key := range cfg.ExtraAuthParams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var options []oauth2.AuthCodeOption
+	for _, key := range keys {
+		if slices.Contains(reservedAuthParams, key) {
+			log.WithField("providerId", cfg.Id).
+				WithField("param", key).
+				Warn("Extra auth param is reserved and will be ignored.")
+			continue
+		}
+		options = append(options, oauth2.SetAuthURLParam(key, cfg.ExtraAuthParams[key]))
+	}
+	if cfg.ResponseMode != "" {
+		options = append(options, oauth2.SetAuthURLParam("response_mode", cfg.ResponseMode))
+	}
+	return options
+}
+
+// verifyIDToken verifies the raw ID token against the keys of the IdP and the client id.
+func (p *Provider) verifyIDToken(ctx context.Context, rawIDToken string) (*oidc.IDToken, error) {
+	verifier := p.provider.Verifier(&oidc.Config{ClientID: p.oauth2Config.ClientID})
+	return verifier.Verify(ctx, rawIDToken)
+}
+
+// accessTokenClaims verifies the access token as JWT against the keys of the IdP and returns its claims.
+// The audience is not checked, because access tokens are often issued for other audiences.
+func (p *Provider) accessTokenClaims(ctx context.Context, accessToken string) (map[string]any, error) {
+	verifier := p.provider.Verifier(&oidc.Config{SkipClientIDCheck: true})
+	token, err := verifier.Verify(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]any
+	err = token.Claims(&claims)
+	return claims, err
+}
+
+// endSessionURL builds the url for the RP-initiated logout at the IdP.
+// It returns false, when the IdP does not provide an end_session_endpoint.
+func (p *Provider) endSessionURL(idTokenHint, postLogoutRedirectUri string) (string, bool) {
+	if p.cfg.EndSessionEndpoint == "" {
+		return "", false
+	}
+	u, err := url.Parse(p.cfg.EndSessionEndpoint)
+	if err != nil {
+		log.WithField("providerId", p.cfg.Id).
+			WithError(err).
+			Warn("Invalid end_session_endpoint.")
+		return "", false
+	}
+	q := u.Query()
+	if idTokenHint != "" {
+		q.Set("id_token_hint", idTokenHint)
+	}
+	q.Set("client_id", p.oauth2Config.ClientID)
+	q.Set("post_logout_redirect_uri", postLogoutRedirectUri)
+	u.RawQuery = q.Encode()
+	return u.String(), true
+}
+
 // resolveFromIdP fetch the data from the well-known url and decode it into itself.
 func (c *ProviderConfig) resolveFromIdP() error {
 	return fetchAndDecodeJson(c.ConfigUrl, c)
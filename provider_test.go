@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"golang.org/x/oauth2"
+)
+
+func TestBuildScopes(t *testing.T) {
+	assert.Equal(t, buildScopes(OIDCProvider{}), []string{"openid", "profile", "email", "groups"})
+	assert.Equal(t, buildScopes(OIDCProvider{OfflineAccess: true}), []string{"openid", "profile", "email", "groups", "offline_access"})
+	assert.Equal(t, buildScopes(OIDCProvider{Scopes: []string{"email", "api"}}), []string{"openid", "email", "api"})
+	assert.Equal(t, buildScopes(OIDCProvider{Scopes: []string{"openid", "offline_access"}, OfflineAccess: true}), []string{"openid", "offline_access"})
+	// the default scopes are not modified
+	assert.Equal(t, defaultScopes, []string{"openid", "profile", "email", "groups"})
+}
+
+func TestBuildAuthOptions(t *testing.T) {
+	options := buildAuthOptions(OIDCProvider{
+		ExtraAuthParams: map[string]string{
+			"prompt":     "login",
+			"login_hint": "jane@example.com",
+			"state":      "overwritten",
+		},
+		ResponseMode: "form_post",
+	})
+	config := oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "http://idp/auth"}}
+	u, err := url.Parse(config.AuthCodeURL("state", options...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	assert.Equal(t, q.Get("prompt"), "login")
+	assert.Equal(t, q.Get("login_hint"), "jane@example.com")
+	assert.Equal(t, q.Get("response_mode"), "form_post")
+	// reserved parameters are not overwritten
+	assert.Equal(t, q.Get("state"), "state")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrProxyProtocolHeader    = errors.New("invalid PROXY protocol header")
+	ErrProxyProtocolUntrusted = errors.New("PROXY protocol requires trusted proxies")
+)
+
+// maximum time to receive the PROXY protocol header
+const proxyProtocolTimeout = 5 * time.Second
+
+// the v1 header is a text line with at most 107 bytes
+const proxyProtocolV1MaxLength = 107
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener reads the PROXY protocol header (v1 and v2) of the connections from the trusted proxies.
+// The header is optional, connections without header keep their remote address.
+// Connections from other addresses are never parsed, so clients can not set their address.
+type proxyProtocolListener struct {
+	net.Listener
+	trustedProxies []*net.IPNet
+}
+
+func newProxyProtocolListener(listener net.Listener, trustedProxies []*net.IPNet) net.Listener {
+	return &proxyProtocolListener{Listener: listener, trustedProxies: trustedProxies}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !ipInCIDRs(remoteIP(conn.RemoteAddr().String()), l.trustedProxies) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn reads the header on the first Read or RemoteAddr call,
+// so a slow proxy does not block the accept loop.
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout)); err != nil {
+			c.err = err
+			return
+		}
+		c.remoteAddr, c.err = readProxyProtocolHeader(c.reader)
+		if err := c.Conn.SetReadDeadline(time.Time{}); err != nil && c.err == nil {
+			c.err = err
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader reads the header and returns the address of the client.
+// It returns nil without error, when there is no header or the header has no address (UNKNOWN or LOCAL).
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if prefix, err := r.Peek(6); err == nil && string(prefix) == "PROXY " {
+			return readProxyProtocolV1(r)
+		}
+	case proxyProtocolV2Signature[0]:
+		if prefix, err := r.Peek(len(proxyProtocolV2Signature)); err == nil && bytes.Equal(prefix, proxyProtocolV2Signature) {
+			return readProxyProtocolV2(r)
+		}
+	}
+	return nil, nil
+}
+
+// readProxyProtocolV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > proxyProtocolV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 line", ErrProxyProtocolHeader)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: v1 fields", ErrProxyProtocolHeader)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: v1 source address", ErrProxyProtocolHeader)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 reads the binary header. TLVs are skipped.
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: v2 header", ErrProxyProtocolHeader)
+	}
+	versionCommand, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("%w: v2 version", ErrProxyProtocolHeader)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("%w: v2 addresses", ErrProxyProtocolHeader)
+	}
+
+	// LOCAL command, e.g. health checks of the proxy
+	if versionCommand&0x0f == 0 {
+		return nil, nil
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: v2 IPv4 addresses", ErrProxyProtocolHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: v2 IPv6 addresses", ErrProxyProtocolHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// unsupported protocols like UDP or unix sockets keep the address of the proxy
+	return nil, nil
+}
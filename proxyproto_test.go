@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func proxyProtocolV2Header(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x11, 0x5c, 0x01, 0xbb}
+	ipv6 := append(append(net.ParseIP("2001:db8::17").To16(), net.ParseIP("2001:db8::1").To16()...), 0x11, 0x5c, 0x01, 0xbb)
+	tests := []struct {
+		header   []byte
+		expected string
+		err      bool
+	}{
+		{[]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4444 443\r\nGET / HTTP/1.1\r\n"), "203.0.113.7:4444", false},
+		{[]byte("PROXY TCP6 2001:db8::17 2001:db8::1 4444 443\r\nGET"), "[2001:db8::17]:4444", false},
+		{[]byte("PROXY UNKNOWN\r\nGET"), "", false},
+		{[]byte("PROXY TCP4 no-ip 10.0.0.1 4444 443\r\nGET"), "", true},
+		{[]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4444 443\nGET"), "", true},
+		{append(proxyProtocolV2Header(1, 0x11, ipv4), "GET"...), "203.0.113.7:4444", false},
+		{append(proxyProtocolV2Header(1, 0x21, ipv6), "GET"...), "[2001:db8::17]:4444", false},
+		// with a TLV after the addresses
+		{append(proxyProtocolV2Header(1, 0x11, append(ipv4, 0x01, 0x00, 0x02, 'h', '2')), "GET"...), "203.0.113.7:4444", false},
+		{append(proxyProtocolV2Header(0, 0x11, ipv4), "GET"...), "", false},
+		{proxyProtocolV2Header(1, 0x11, ipv4[:4]), "", true},
+		// no header
+		{[]byte("GET / HTTP/1.1\r\n"), "", false},
+		{[]byte("POST / HTTP/1.1\r\n"), "", false},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(bytes.NewReader(test.header))
+		addr, err := readProxyProtocolHeader(r)
+		if test.err {
+			assert.Equal(t, errors.Is(err, ErrProxyProtocolHeader), true)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", test.header, err)
+		}
+		if test.expected == "" {
+			assert.Equal(t, addr, nil)
+		} else {
+			assert.Equal(t, addr.String(), test.expected)
+		}
+		// the request after the header is kept
+		rest, _ := io.ReadAll(r)
+		if !bytes.HasPrefix(rest, []byte("GET")) && !bytes.HasPrefix(rest, []byte("POST")) {
+			t.Errorf("request after the header %q is lost: %q", test.header, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	request := func(trusted string, header string) (int, string) {
+		t.Helper()
+		trustedProxies, err := parseCIDRs([]string{trusted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, r.RemoteAddr)
+		})}
+		go func() { _ = server.Serve(newProxyProtocolListener(listener, trustedProxies)) }()
+		defer func() { _ = server.Close() }()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = conn.Close() }()
+		_, err = io.WriteString(conn, header+"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	status, remoteAddr := request("127.0.0.1", "PROXY TCP4 203.0.113.7 10.0.0.1 4444 443\r\n")
+	assert.Equal(t, status, http.StatusOK)
+	assert.Equal(t, remoteAddr, "203.0.113.7:4444")
+	// the header is optional for the trusted proxies
+	_, remoteAddr = request("127.0.0.1", "")
+	assert.Equal(t, strings.HasPrefix(remoteAddr, "127.0.0.1:"), true)
+	// other clients can not set their address
+	status, _ = request("10.0.0.1", "PROXY TCP4 203.0.113.7 10.0.0.1 4444 443\r\n")
+	assert.Equal(t, status, http.StatusBadRequest)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// isAllowedRedirect checks if the target is a safe redirect target after the login to prevent open redirects.
+// Allowed are relative paths below the url of one of the static pages and absolute urls
+// to one of the allowed redirect hosts.
+// Absolute urls to the host of the base url are handled like relative paths.
+func (o *OIDC) isAllowedRedirect(target string) bool {
+	// backslashes are interpreted as slashes by some browsers
+	if target == "" || strings.ContainsAny(target, "\\\r\n") {
+		return false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	if u.IsAbs() || u.Host != "" {
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return false
+		}
+		if o.isAllowedRedirectHost(u.Host) {
+			return true
+		}
+		base, err := url.Parse(o.baseUrl)
+		if err != nil || !strings.EqualFold(base.Host, u.Host) {
+			return false
+		}
+	} else if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		return false
+	}
+
+	return o.isStaticPagePath(u.Path)
+}
+
+// isAllowedRedirectHost checks the host (with or without port) against the allowed redirect hosts.
+func (o *OIDC) isAllowedRedirectHost(host string) bool {
+	hostname := host
+	if u, err := url.Parse("//" + host); err == nil {
+		hostname = u.Hostname()
+	}
+	for _, allowed := range o.cfg.Content.OIDC.AllowedRedirectHosts {
+		if strings.EqualFold(allowed, host) || strings.EqualFold(allowed, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStaticPagePath checks if the cleaned path is below the url of one of the static pages.
+func (o *OIDC) isStaticPagePath(p string) bool {
+	if p == "" {
+		p = "/"
+	}
+	cleaned := path.Clean(p)
+	for _, page := range o.cfg.Content.StaticPages {
+		prefix := strings.TrimRight(page.Url, "/")
+		if prefix == "" || cleaned == prefix || strings.HasPrefix(cleaned, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isNavigationRequest checks if the request is a top-level navigation of a browser,
+// which can be redirected to the login.
+// Non-GET requests, fetch calls, XMLHttpRequests and requests for other content than HTML are no navigations.
+// Requests without any of these hints (e.g. from curl) are handled as navigation.
+func isNavigationRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	if r.Header.Get("X-Requested-With") != "" {
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" || strings.Contains(accept, "text/html") {
+		return true
+	}
+	if strings.Contains(accept, "application/json") {
+		return false
+	}
+	return strings.Contains(accept, "*/*")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsAllowedRedirect(t *testing.T) {
+	o := &OIDC{
+		baseUrl: "https://files.example.com",
+		cfg: &Config{Content: ContentConfig{
+			OIDC: ContentConfigOIDC{AllowedRedirectHosts: []string{"app.example.com", "tools.example.com:8443"}},
+			StaticPages: []StaticPage{
+				{Id: "docs", Url: "/docs/"},
+				{Id: "files", Url: "/files"},
+			},
+		}},
+	}
+
+	tests := []struct {
+		target   string
+		expected bool
+	}{
+		{"/docs/index.html", true},
+		{"/docs/index.html?version=2", true},
+		{"/docs", true},
+		{"/files/a/b.txt?x=1&y=2", true},
+		{"/filesystem/secret", false},
+		{"/other/page", false},
+		{"/docs/../other", false},
+		{"", false},
+		{"docs/index.html", false},
+		{"//evil.com/docs/", false},
+		{"/\\evil.com", false},
+		{"https://evil.com/docs/", false},
+		{"https://files.example.com/docs/a", true},
+		{"https://files.example.com/other", false},
+		{"https://app.example.com/anything", true},
+		{"http://tools.example.com:8443/x", true},
+		{"http://tools.example.com/x", false},
+		{"javascript://app.example.com/%0aalert(1)", false},
+	}
+	for _, test := range tests {
+		if result := o.isAllowedRedirect(test.target); result != test.expected {
+			t.Errorf("unexpected result for %q: got %v, want %v", test.target, result, test.expected)
+		}
+	}
+}
+
+func TestIsNavigationRequest(t *testing.T) {
+	tests := []struct {
+		method   string
+		headers  map[string]string
+		expected bool
+	}{
+		{http.MethodGet, nil, true},
+		{http.MethodGet, map[string]string{"Accept": "*/*"}, true},
+		{http.MethodGet, map[string]string{"Accept": "text/html,application/xhtml+xml,*/*;q=0.8"}, true},
+		{http.MethodGet, map[string]string{"Sec-Fetch-Mode": "navigate", "Accept": "text/html"}, true},
+		{http.MethodGet, map[string]string{"Sec-Fetch-Mode": "cors", "Accept": "*/*"}, false},
+		{http.MethodGet, map[string]string{"Sec-Fetch-Mode": "no-cors", "Accept": "image/avif,image/webp,*/*"}, false},
+		{http.MethodGet, map[string]string{"Accept": "application/json"}, false},
+		{http.MethodGet, map[string]string{"Accept": "image/png"}, false},
+		{http.MethodGet, map[string]string{"X-Requested-With": "XMLHttpRequest"}, false},
+		{http.MethodHead, nil, false},
+		{http.MethodPost, map[string]string{"Accept": "text/html"}, false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/docs/index.html", nil)
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		if result := isNavigationRequest(req); result != test.expected {
+			t.Errorf("unexpected result for %s %v: got %v, want %v", test.method, test.headers, result, test.expected)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var ErrPageRuleInvalid = errors.New("page rule must either be public or have a protection")
+
+// pageRule is a compiled StaticPageRule.
+type pageRule struct {
+	path string
+	// nil for public rules
+	protector echo.MiddlewareFunc
+	policy    *AccessPolicy
+	limits    ExpressionLimits
+}
+
+// matches checks if the path relative to the page matches the glob of the rule.
+// A directory path without trailing slash also matches "dir/**", because it serves the index of the directory.
+func (r pageRule) matches(relativePath string) bool {
+	return globMatch(r.path, relativePath) ||
+		(!strings.HasSuffix(relativePath, "/") && globMatch(r.path, relativePath+"/"))
+}
+
+// normalizeRulePath adds the leading slash to the glob of a rule.
+func normalizeRulePath(rulePath string) string {
+	if !strings.HasPrefix(rulePath, "/") {
+		return "/" + rulePath
+	}
+	return rulePath
+}
+
+// relativePagePath returns the cleaned path relative to the url of the page.
+// The path is cleaned, so dot segments can not be used to skip a rule, a trailing slash is kept.
+func relativePagePath(baseUrl, requestPath string) string {
+	relativePath := strings.TrimPrefix(requestPath, baseUrl)
+	cleaned := path.Clean("/" + relativePath)
+	if strings.HasSuffix(relativePath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// validatePageRule checks that the rule is either public or has a protection.
+func validatePageRule(rule StaticPageRule) error {
+	if rule.Public == (rule.Protection != nil) {
+		return fmt.Errorf("%w: %s", ErrPageRuleInvalid, rule.Path)
+	}
+	return nil
+}
+
+// ruleFor returns the first rule matching the path.
+func ruleFor(relativePath string, rules []pageRule) (pageRule, bool) {
+	for _, rule := range rules {
+		if rule.matches(relativePath) {
+			return rule, true
+		}
+	}
+	return pageRule{}, false
+}
+
+// policyFor returns the policy of the first rule matching the path or the fallback policy.
+// It is nil, when the path is public.
+func policyFor(relativePath string, rules []pageRule, fallback *AccessPolicy) *AccessPolicy {
+	if rule, ok := ruleFor(relativePath, rules); ok {
+		return rule.policy
+	}
+	return fallback
+}
+
+// newPageNetworkMiddleware creates a middleware, which denies the networks of the policy for the request path.
+// It runs before the share links and the access files, so they can not be used from a denied network.
+// It is nil, when neither the page nor a rule has network rules.
+func newPageNetworkMiddleware(baseUrl string, rules []pageRule, fallback *AccessPolicy) echo.MiddlewareFunc {
+	hasNetworkRules := fallback != nil && fallback.hasNetworkRules()
+	for _, rule := range rules {
+		hasNetworkRules = hasNetworkRules || (rule.policy != nil && rule.policy.hasNetworkRules())
+	}
+	if !hasNetworkRules {
+		return nil
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			policy := policyFor(relativePagePath(baseUrl, c.Request().URL.Path), rules, fallback)
+			if policy != nil && policy.checkNetwork(net.ParseIP(c.RealIP())) == networkDenied {
+				return c.String(http.StatusForbidden, "Access from your network is not allowed.")
+			}
+			return next(c)
+		}
+	}
+}
+
+// newPageRulesMiddleware creates a middleware, which selects the protection by the request path.
+// The first rule matching the path relative to the baseUrl wins. Public rules skip the protection.
+// When no rule matches, the fallback protection is used, which can be nil for public pages.
+func newPageRulesMiddleware(baseUrl string, rules []pageRule, fallback echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cleaned := relativePagePath(baseUrl, c.Request().URL.Path)
+			for _, rule := range rules {
+				if !rule.matches(cleaned) {
+					continue
+				}
+				if rule.protector == nil {
+					return next(c)
+				}
+				return rule.protector(next)(c)
+			}
+
+			if fallback == nil {
+				return next(c)
+			}
+			return fallback(next)(c)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestPageRules(t *testing.T) {
+	// protector, which answers with the given name instead of calling the next handler
+	protector := func(name string) echo.MiddlewareFunc {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				return c.String(http.StatusForbidden, name)
+			}
+		}
+	}
+	rules := []pageRule{
+		{path: normalizeRulePath("assets/**")},
+		{path: "/internal/**", protector: protector("staff")},
+		{path: "/finance/*.pdf", protector: protector("finance")},
+	}
+	handler := newPageRulesMiddleware("/docs", rules, protector("page"))(func(c echo.Context) error {
+		return c.String(http.StatusOK, "content")
+	})
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/docs/assets/style.css", "content"},
+		{"/docs/assets/img/logo.png", "content"},
+		{"/docs/internal/index.html", "staff"},
+		{"/docs/internal/", "staff"},
+		{"/docs/internal", "staff"},
+		{"/docs/assets/../internal/index.html", "staff"},
+		{"/docs/finance/report.pdf", "finance"},
+		{"/docs/finance/2024/report.pdf", "page"},
+		{"/docs/index.html", "page"},
+		{"/docs", "page"},
+	}
+	for _, test := range tests {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = test.path
+		rec := httptest.NewRecorder()
+		if err := handler(e.NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Body.String() != test.expected {
+			t.Errorf("unexpected handler for %s: got %s, want %s", test.path, rec.Body.String(), test.expected)
+		}
+	}
+}
+
+func TestValidatePageRule(t *testing.T) {
+	tests := []struct {
+		rule  StaticPageRule
+		valid bool
+	}{
+		{StaticPageRule{Path: "/assets/**", Public: true}, true},
+		{StaticPageRule{Path: "/internal/**", Protection: &StaticPageProtection{Provider: "idp"}}, true},
+		{StaticPageRule{Path: "/internal/**"}, false},
+		{StaticPageRule{Path: "/internal/**", Public: true, Protection: &StaticPageProtection{Provider: "idp"}}, false},
+	}
+	for _, test := range tests {
+		err := validatePageRule(test.rule)
+		if test.valid && err != nil {
+			t.Errorf("expected rule %+v to be valid, got %v", test.rule, err)
+		}
+		if !test.valid && !errors.Is(err, ErrPageRuleInvalid) {
+			t.Errorf("expected rule %+v to be invalid, got %v", test.rule, err)
+		}
+	}
+}
@@ -2,16 +2,39 @@ package main
 
 import (
 	"encoding/gob"
+	"time"
 )
 
 const sessionName = "oidc_auth_session"
 const providerSessionsKey = "oidc_provider_sessions"
 
+// maximum size of the encoded session data in the store (not the cookie),
+// the default of 4096 bytes is too small for the stored tokens
+const sessionMaxLength = 64 * 1024
+
 type ProviderSession struct {
 	ExpiresAt int64          `json:"expires_at"`
 	Subject   string         `json:"subject"`
 	Groups    []string       `json:"groups"`
 	UserInfo  map[string]any `json:"user_info"`
+	// raw id token, used as id_token_hint on logout
+	IDToken string `json:"id_token"`
+	// encrypted refresh token for the silent renewal
+	RefreshToken string `json:"refresh_token"`
+	// encrypted access token for the token endpoint and the token relay
+	AccessToken string `json:"access_token"`
+	// claims of the verified id token
+	IDTokenClaims map[string]any `json:"id_token_claims"`
+}
+
+// Expired reports if the access token of the session is expired.
+func (s ProviderSession) Expired() bool {
+	return s.ExpiresWithin(0)
+}
+
+// ExpiresWithin reports if the access token of the session expires within the duration.
+func (s ProviderSession) ExpiresWithin(d time.Duration) bool {
+	return s.ExpiresAt > 0 && s.ExpiresAt < time.Now().Add(d).Unix()
 }
 
 func init() {
@@ -19,4 +42,7 @@ func init() {
 	gob.Register(ProviderSession{})
 	// map format: providerId -> Session for the provider
 	gob.Register(map[string]ProviderSession{})
+	// nested claim values
+	gob.Register(map[string]any{})
+	gob.Register([]any{})
 }
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrShareLinkKey             = errors.New("share link key must not be empty")
+	ErrShareLinkInvalid         = errors.New("share link is invalid")
+	ErrShareLinkExpired         = errors.New("share link is expired")
+	ErrShareLinkRevoked         = errors.New("share link is revoked")
+	ErrShareLinkUsedUp          = errors.New("share link has no uses left")
+	ErrShareLinkPageUnprotected = errors.New("share links require a protected page")
+	ErrShareLinkAccessFile      = errors.New("share links are not available for paths restricted by an access file")
+)
+
+// query parameter, which carries the signed share link
+const shareLinkParam = "share"
+
+// shareLink is the signed content of a share link.
+type shareLink struct {
+	Id   string `json:"id"`
+	Page string `json:"page"`
+	// path relative to the url of the page
+	Path string `json:"path"`
+	// the link also grants access to all paths below the path
+	Prefix    bool  `json:"prefix,omitempty"`
+	ExpiresAt int64 `json:"exp"`
+	// 0 for unlimited uses
+	MaxUses int `json:"max_uses,omitempty"`
+}
+
+// allows checks if the cleaned path relative to the page is covered by the link.
+func (l shareLink) allows(relativePath string) bool {
+	if !l.Prefix {
+		return relativePath == l.Path
+	}
+	if l.Path == "/" {
+		return true
+	}
+	return relativePath == l.Path || strings.HasPrefix(relativePath, l.Path+"/")
+}
+
+// shareSigner signs the share links with HMAC-SHA256.
+// The key is derived from the session key, so it differs from the key of the tokenCipher.
+type shareSigner struct {
+	key []byte
+}
+
+// newShareSigner creates a shareSigner from the given key.
+func newShareSigner(key string) (*shareSigner, error) {
+	if key == "" {
+		return nil, ErrShareLinkKey
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("share-links"))
+	return &shareSigner{key: mac.Sum(nil)}, nil
+}
+
+func (s *shareSigner) mac(payload string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// sign returns the base64 encoded link and its signature, separated by a dot.
+func (s *shareSigner) sign(link shareLink) (string, error) {
+	payload, err := json.Marshal(link)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded)), nil
+}
+
+// verify reverts sign.
+// It returns ErrShareLinkInvalid if the token is malformed or the signature does not match.
+func (s *shareSigner) verify(token string) (shareLink, error) {
+	var link shareLink
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return link, ErrShareLinkInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.mac(encoded)) {
+		return link, ErrShareLinkInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return link, ErrShareLinkInvalid
+	}
+	if err := json.Unmarshal(payload, &link); err != nil {
+		return link, fmt.Errorf("%w: %v", ErrShareLinkInvalid, err)
+	}
+	return link, nil
+}
+
+// shareLinks signs and checks the share links of all pages.
+type shareLinks struct {
+	signer *shareSigner
+	store  shareStore
+	pages  map[string]*shareLinkPage
+}
+
+// shareLinkPage is a page with enabled share links.
+type shareLinkPage struct {
+	id  string
+	url string
+	cfg *StaticPageShareLinks
+	// checks the protection of the page or of the matching rule for the path of the request
+	access echo.MiddlewareFunc
+	// checks the protection of the page and of all rules, required for prefix links
+	full echo.MiddlewareFunc
+	// access files of the page, nil for upstream pages
+	files *accessFiles
+}
+
+// shareLinkRequest is the request of the share link endpoint.
+type shareLinkRequest struct {
+	// path relative to the url of the page
+	Path   string `json:"path" form:"path"`
+	Prefix bool   `json:"prefix" form:"prefix"`
+	// duration like "24h", defaults to the default ttl of the page
+	TTL     string `json:"ttl" form:"ttl"`
+	MaxUses int    `json:"max_uses" form:"max_uses"`
+}
+
+// shareLinkResponse is the response of the share link endpoint.
+type shareLinkResponse struct {
+	Url       string `json:"url"`
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expires_at"`
+	MaxUses   int    `json:"max_uses,omitempty"`
+}
+
+// shareLinkRevokeRequest is the request of the revoke endpoint.
+type shareLinkRevokeRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
+// createShareLinks creates the signer and the store for the share links.
+// The store uses the backend of the sessions.
+func (w *Webserver) createShareLinks() (*shareLinks, error) {
+	signer, err := newShareSigner(w.cfg.Settings.Session.Key)
+	if err != nil {
+		return nil, err
+	}
+	var store shareStore
+	if w.redisStore != nil {
+		store = &redisShareStore{pool: w.redisStore.Pool}
+	} else {
+		store, err = newFsShareStore(w.cfg.Settings.Session.StoreDirectory)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &shareLinks{
+		signer: signer,
+		store:  store,
+		pages:  make(map[string]*shareLinkPage),
+	}, nil
+}
+
+// check verifies the token for the page and the path relative to the page and counts the use.
+func (s *shareLinks) check(token, pageId, relativePath string) (shareLink, error) {
+	link, err := s.signer.verify(token)
+	if err != nil {
+		return link, err
+	}
+	if link.Page != pageId || !link.allows(relativePath) {
+		return link, fmt.Errorf("%w: not valid for the path %s", ErrShareLinkInvalid, relativePath)
+	}
+	if link.ExpiresAt < time.Now().Unix() {
+		return link, ErrShareLinkExpired
+	}
+	revoked, err := s.store.revoked(link.Id)
+	if err != nil {
+		return link, err
+	}
+	if revoked {
+		return link, ErrShareLinkRevoked
+	}
+	if link.MaxUses > 0 {
+		uses, err := s.store.use(link.Id, link.ExpiresAt)
+		if err != nil {
+			return link, err
+		}
+		if uses > link.MaxUses {
+			return link, ErrShareLinkUsedUp
+		}
+	}
+	return link, nil
+}
+
+// middleware accepts a valid share link of the page in place of a session.
+// Requests without share link are passed to the access middleware of the page.
+func (s *shareLinks) middleware(pageId, baseUrl string, access echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		protected := access(next)
+		return func(c echo.Context) error {
+			token := c.QueryParam(shareLinkParam)
+			if token == "" {
+				return protected(c)
+			}
+			r := c.Request()
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				return c.String(http.StatusMethodNotAllowed, "share links only allow GET and HEAD requests")
+			}
+			link, err := s.check(token, pageId, relativePagePath(baseUrl, r.URL.Path))
+			if err != nil {
+				log.WithField("id", link.Id).WithError(err).Debug("Share link rejected")
+				return shareLinkErrorResponse(c, err)
+			}
+			// the link must not leak to other sites or caches
+			c.Response().Header().Set("Referrer-Policy", "no-referrer")
+			c.Response().Header().Set(echo.HeaderCacheControl, "private, no-store")
+			return next(c)
+		}
+	}
+}
+
+// shareLinkErrorResponse answers invalid links with 403 and links, which are no longer valid, with 410.
+func shareLinkErrorResponse(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, ErrShareLinkInvalid):
+		return c.String(http.StatusForbidden, ErrShareLinkInvalid.Error())
+	case errors.Is(err, ErrShareLinkExpired), errors.Is(err, ErrShareLinkRevoked), errors.Is(err, ErrShareLinkUsedUp):
+		return c.String(http.StatusGone, err.Error())
+	}
+	log.WithError(err).Error("Error checking share link")
+	return c.String(http.StatusInternalServerError, "error checking share link")
+}
+
+// authorize runs the protection for the shared path, before it calls next with the original request.
+// A prefix link requires access to the page and to all rules of the page.
+func (p *shareLinkPage) authorize(c echo.Context, linkPath string, prefix bool, next echo.HandlerFunc) error {
+	check := p.access
+	if prefix {
+		check = p.full
+	}
+	r := c.Request()
+	checkRequest := r.Clone(r.Context())
+	checkRequest.URL.Path = p.url + linkPath
+	checkRequest.URL.RawPath = ""
+	c.SetRequest(checkRequest)
+	return check(func(c echo.Context) error {
+		c.SetRequest(r)
+		return next(c)
+	})(c)
+}
+
+// createShareLinkHandler creates the endpoint, which mints a share link for a path of the page.
+// The user must be logged in, have access to the shared path and only same-origin script requests are answered.
+func (w *Webserver) createShareLinkHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		page, ok := w.shareLinks.pages[c.QueryParam("page")]
+		if !ok {
+			return c.String(http.StatusNotFound, "share links are not enabled for the page")
+		}
+		if !isSameOriginRequest(c.Request()) {
+			return c.String(http.StatusForbidden, "cross-origin share link request")
+		}
+
+		var req shareLinkRequest
+		if err := c.Bind(&req); err != nil {
+			return c.String(http.StatusBadRequest, "invalid share link request")
+		}
+		if req.Path == "" {
+			return c.String(http.StatusBadRequest, "path is required")
+		}
+		if req.MaxUses < 0 {
+			return c.String(http.StatusBadRequest, "max_uses must not be negative")
+		}
+		ttl := page.cfg.DefaultTTL
+		if req.TTL != "" {
+			var err error
+			ttl, err = time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				return c.String(http.StatusBadRequest, "invalid ttl")
+			}
+		}
+		if ttl > page.cfg.MaxTTL {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("ttl exceeds the maximum of %s", page.cfg.MaxTTL))
+		}
+		linkPath := path.Clean("/" + req.Path)
+
+		return page.authorize(c, linkPath, req.Prefix, func(c echo.Context) error {
+			// networks, which bypass the login, can not create links
+			accessContext, ok := c.Get(accessContextKey).(*AccessContext)
+			if !ok {
+				return c.String(http.StatusUnauthorized, "share links require a login")
+			}
+			// the access files are also applied to share links, so the link would never grant access
+			if page.files != nil {
+				restricted, err := page.files.restricts(linkPath, req.Prefix)
+				if err != nil {
+					return c.String(http.StatusInternalServerError, "The access file of this directory is invalid.")
+				}
+				if restricted {
+					return c.String(http.StatusForbidden, ErrShareLinkAccessFile.Error())
+				}
+			}
+
+			id := make([]byte, 16)
+			if _, err := rand.Read(id); err != nil {
+				return err
+			}
+			link := shareLink{
+				Id:        hex.EncodeToString(id),
+				Page:      page.id,
+				Path:      linkPath,
+				Prefix:    req.Prefix,
+				ExpiresAt: time.Now().Add(ttl).Unix(),
+				MaxUses:   req.MaxUses,
+			}
+			token, err := w.shareLinks.signer.sign(link)
+			if err != nil {
+				log.WithError(err).Error("Error signing share link")
+				return c.String(http.StatusInternalServerError, "error creating share link")
+			}
+			if err := w.shareLinks.store.cleanup(); err != nil {
+				log.WithError(err).Warn("Error removing expired share links")
+			}
+
+			log.WithFields(log.Fields{
+				"id":      link.Id,
+				"page":    page.id,
+				"path":    linkPath,
+				"prefix":  link.Prefix,
+				"subject": accessContext.Subject,
+			}).Info("Share link created")
+
+			c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+			return c.JSON(http.StatusOK, shareLinkResponse{
+				Url:       w.cfg.Content.OIDC.BaseUrl + shareLinkURL(page.url+linkPath, token),
+				Token:     token,
+				ExpiresAt: link.ExpiresAt,
+				MaxUses:   link.MaxUses,
+			})
+		})
+	}
+}
+
+// shareLinkURL returns the escaped path with the share link, relative to the base url.
+func shareLinkURL(linkPath, token string) string {
+	return (&url.URL{Path: linkPath, RawQuery: shareLinkParam + "=" + url.QueryEscape(token)}).String()
+}
+
+// createShareLinkRevokeHandler creates the endpoint, which revokes a share link of the page.
+// The user must have the same access as for creating the link.
+func (w *Webserver) createShareLinkRevokeHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		page, ok := w.shareLinks.pages[c.QueryParam("page")]
+		if !ok {
+			return c.String(http.StatusNotFound, "share links are not enabled for the page")
+		}
+		if !isSameOriginRequest(c.Request()) {
+			return c.String(http.StatusForbidden, "cross-origin share link request")
+		}
+
+		var req shareLinkRevokeRequest
+		if err := c.Bind(&req); err != nil {
+			return c.String(http.StatusBadRequest, "invalid share link request")
+		}
+		link, err := w.shareLinks.signer.verify(req.Token)
+		if err != nil || link.Page != page.id {
+			return c.String(http.StatusBadRequest, ErrShareLinkInvalid.Error())
+		}
+
+		return page.authorize(c, link.Path, link.Prefix, func(c echo.Context) error {
+			accessContext, ok := c.Get(accessContextKey).(*AccessContext)
+			if !ok {
+				return c.String(http.StatusUnauthorized, "share links require a login")
+			}
+			if err := w.shareLinks.store.revoke(link.Id, link.ExpiresAt); err != nil {
+				log.WithField("id", link.Id).WithError(err).Error("Error revoking share link")
+				return c.String(http.StatusInternalServerError, "error revoking share link")
+			}
+			log.WithFields(log.Fields{"id": link.Id, "page": page.id, "subject": accessContext.Subject}).Info("Share link revoked")
+			return c.NoContent(http.StatusNoContent)
+		})
+	}
+}
+
+// createPageShareLinks enables the share links for the page and returns the access middleware,
+// which accepts the share links in place of a session.
+func (w *Webserver) createPageShareLinks(config StaticPage, baseContentUrl string, access, protector echo.MiddlewareFunc, ruleProtectors []echo.MiddlewareFunc, files *accessFiles) (echo.MiddlewareFunc, error) {
+	if protector == nil {
+		return nil, fmt.Errorf("%w: %s", ErrShareLinkPageUnprotected, config.Id)
+	}
+	w.shareLinks.pages[config.Id] = &shareLinkPage{
+		id:     config.Id,
+		url:    baseContentUrl,
+		cfg:    config.ShareLinks,
+		access: access,
+		full:   chainMiddlewares(append([]echo.MiddlewareFunc{protector}, ruleProtectors...)),
+		files:  files,
+	}
+	log.WithFields(log.Fields{
+		"id":      config.Id,
+		"max_ttl": config.ShareLinks.MaxTTL,
+	}).Info("enabling share links for static page")
+	return w.shareLinks.middleware(config.Id, baseContentUrl, access), nil
+}
+
+// chainMiddlewares combines the middlewares, the first middleware runs first.
+func chainMiddlewares(middlewares []echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestShareSigner(t *testing.T) {
+	s, err := newShareSigner("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link := shareLink{Id: "abc", Page: "reports", Path: "/q3.pdf", ExpiresAt: 1700000000, MaxUses: 3}
+	token, err := s.sign(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, err := s.verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, verified, link)
+
+	// modified signature or payload
+	_, err = s.verify(token[:len(token)-2] + "AA")
+	assert.Equal(t, errors.Is(err, ErrShareLinkInvalid), true)
+	other, _ := s.sign(shareLink{Id: "abc", Page: "reports", Path: "/", Prefix: true})
+	_, err = s.verify(other[:len(other)/2] + token[len(token)/2:])
+	assert.Equal(t, errors.Is(err, ErrShareLinkInvalid), true)
+	_, err = s.verify("no-signature")
+	assert.Equal(t, errors.Is(err, ErrShareLinkInvalid), true)
+
+	// other key
+	otherSigner, err := newShareSigner("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = otherSigner.verify(token)
+	assert.Equal(t, errors.Is(err, ErrShareLinkInvalid), true)
+
+	_, err = newShareSigner("")
+	assert.Equal(t, errors.Is(err, ErrShareLinkKey), true)
+}
+
+func TestShareLinkAllows(t *testing.T) {
+	tests := []struct {
+		link     shareLink
+		path     string
+		expected bool
+	}{
+		{shareLink{Path: "/q3.pdf"}, "/q3.pdf", true},
+		{shareLink{Path: "/q3.pdf"}, "/q3.pdf/", false},
+		{shareLink{Path: "/q3.pdf"}, "/q4.pdf", false},
+		{shareLink{Path: "/reports"}, "/reports/q3.pdf", false},
+		{shareLink{Path: "/reports", Prefix: true}, "/reports", true},
+		{shareLink{Path: "/reports", Prefix: true}, "/reports/", true},
+		{shareLink{Path: "/reports", Prefix: true}, "/reports/2024/q3.pdf", true},
+		{shareLink{Path: "/reports", Prefix: true}, "/reports-old/q3.pdf", false},
+		{shareLink{Path: "/", Prefix: true}, "/q3.pdf", true},
+	}
+	for _, test := range tests {
+		if result := test.link.allows(test.path); result != test.expected {
+			t.Errorf("unexpected result for %+v and %s: got %v, want %v", test.link, test.path, result, test.expected)
+		}
+	}
+}
+
+func TestShareLinksCheck(t *testing.T) {
+	signer, err := newShareSigner("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFsShareStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := &shareLinks{signer: signer, store: store}
+	sign := func(link shareLink) string {
+		t.Helper()
+		token, err := signer.sign(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	expiresAt := time.Now().Add(time.Hour).Unix()
+
+	token := sign(shareLink{Id: "a1", Page: "reports", Path: "/q3.pdf", ExpiresAt: expiresAt, MaxUses: 2})
+	_, err = links.check(token, "reports", "/q3.pdf")
+	assert.Equal(t, err, nil)
+	_, err = links.check(token, "other", "/q3.pdf")
+	assert.Equal(t, errors.Is(err, ErrShareLinkInvalid), true)
+	_, err = links.check(token, "reports", "/q4.pdf")
+	assert.Equal(t, errors.Is(err, ErrShareLinkInvalid), true)
+	_, err = links.check(token, "reports", "/q3.pdf")
+	assert.Equal(t, err, nil)
+	_, err = links.check(token, "reports", "/q3.pdf")
+	assert.Equal(t, errors.Is(err, ErrShareLinkUsedUp), true)
+
+	// unlimited uses until the link is revoked
+	unlimited := shareLink{Id: "b2", Page: "reports", Path: "/", Prefix: true, ExpiresAt: expiresAt}
+	token = sign(unlimited)
+	for range 3 {
+		_, err = links.check(token, "reports", "/q3.pdf")
+		assert.Equal(t, err, nil)
+	}
+	assert.Equal(t, store.revoke(unlimited.Id, unlimited.ExpiresAt), nil)
+	_, err = links.check(token, "reports", "/q3.pdf")
+	assert.Equal(t, errors.Is(err, ErrShareLinkRevoked), true)
+
+	expired := sign(shareLink{Id: "c3", Page: "reports", Path: "/q3.pdf", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	_, err = links.check(expired, "reports", "/q3.pdf")
+	assert.Equal(t, errors.Is(err, ErrShareLinkExpired), true)
+}
+
+func TestFsShareStoreCleanup(t *testing.T) {
+	store, err := newFsShareStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, store.revoke("expired", time.Now().Add(-time.Minute).Unix()), nil)
+	assert.Equal(t, store.revoke("valid", time.Now().Add(time.Minute).Unix()), nil)
+	assert.Equal(t, store.cleanup(), nil)
+
+	revoked, err := store.revoked("expired")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, revoked, false)
+	revoked, err = store.revoked("valid")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, revoked, true)
+}
+
+func TestShareLinkTTL(t *testing.T) {
+	process := func(shareLinks *StaticPageShareLinks) error {
+		cfg := &ContentConfig{StaticPages: []StaticPage{{Id: "reports", ShareLinks: shareLinks}}}
+		return cfg.Process()
+	}
+
+	shareLinks := &StaticPageShareLinks{Enabled: true, MaxTTL: time.Hour}
+	assert.Equal(t, process(shareLinks), nil)
+	assert.Equal(t, shareLinks.DefaultTTL, time.Hour)
+
+	// the default lifetime can not exceed the maximum
+	assert.NotEqual(t, process(&StaticPageShareLinks{Enabled: true, DefaultTTL: 2 * time.Hour, MaxTTL: time.Hour}), nil)
+	assert.NotEqual(t, process(&StaticPageShareLinks{Enabled: true, DefaultTTL: 30 * 24 * time.Hour}), nil)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// shareStore keeps the use counts and the revocations of the share links.
+// The records are kept until the link expires.
+type shareStore interface {
+	// use counts a use of the link and returns the number of uses including this one
+	use(id string, expiresAt int64) (int, error)
+	revoke(id string, expiresAt int64) error
+	revoked(id string) (bool, error)
+	// cleanup removes the records of expired links
+	cleanup() error
+}
+
+// shareRecord is the state of a share link in the filesystem store.
+type shareRecord struct {
+	ExpiresAt int64 `json:"expires_at"`
+	Uses      int   `json:"uses"`
+	Revoked   bool  `json:"revoked"`
+}
+
+// fsShareStore stores a JSON file per share link in the directory of the session store.
+type fsShareStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newFsShareStore(sessionDir string) (*fsShareStore, error) {
+	dir := filepath.Join(sessionDir, "share_links")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fsShareStore{dir: dir}, nil
+}
+
+func (s *fsShareStore) use(id string, expiresAt int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, err := s.read(id)
+	if err != nil {
+		return 0, err
+	}
+	record.ExpiresAt = expiresAt
+	record.Uses++
+	return record.Uses, s.write(id, record)
+}
+
+func (s *fsShareStore) revoke(id string, expiresAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, err := s.read(id)
+	if err != nil {
+		return err
+	}
+	record.ExpiresAt = expiresAt
+	record.Revoked = true
+	return s.write(id, record)
+}
+
+func (s *fsShareStore) revoked(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, err := s.read(id)
+	return record.Revoked, err
+}
+
+func (s *fsShareStore) cleanup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	var errs []error
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		record, err := s.read(id)
+		if err == nil && record.ExpiresAt >= now {
+			continue
+		}
+		errs = append(errs, os.Remove(s.path(id)))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *fsShareStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// read returns the record of the link, or an empty record if the link has none.
+func (s *fsShareStore) read(id string) (shareRecord, error) {
+	var record shareRecord
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return record, nil
+	} else if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+// write replaces the record atomically, so a crash can not leave a partial file.
+func (s *fsShareStore) write(id string, record shareRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(id))
+}
+
+// redisShareStore stores a hash per share link, which expires with the link.
+type redisShareStore struct {
+	pool *redis.Pool
+}
+
+const redisShareKeyPrefix = "share_link_"
+
+func (s *redisShareStore) use(id string, expiresAt int64) (int, error) {
+	conn := s.pool.Get()
+	defer func() { _ = conn.Close() }()
+	key := redisShareKeyPrefix + id
+	uses, err := redis.Int(conn.Do("HINCRBY", key, "uses", 1))
+	if err != nil {
+		return 0, fmt.Errorf("counting share link use: %w", err)
+	}
+	if _, err := conn.Do("EXPIREAT", key, expiresAt); err != nil {
+		return 0, fmt.Errorf("setting share link expiry: %w", err)
+	}
+	return uses, nil
+}
+
+func (s *redisShareStore) revoke(id string, expiresAt int64) error {
+	conn := s.pool.Get()
+	defer func() { _ = conn.Close() }()
+	key := redisShareKeyPrefix + id
+	if _, err := conn.Do("HSET", key, "revoked", 1); err != nil {
+		return fmt.Errorf("revoking share link: %w", err)
+	}
+	if _, err := conn.Do("EXPIREAT", key, expiresAt); err != nil {
+		return fmt.Errorf("setting share link expiry: %w", err)
+	}
+	return nil
+}
+
+func (s *redisShareStore) revoked(id string) (bool, error) {
+	conn := s.pool.Get()
+	defer func() { _ = conn.Close() }()
+	revoked, err := redis.Bool(conn.Do("HGET", redisShareKeyPrefix+id, "revoked"))
+	if errors.Is(err, redis.ErrNil) {
+		return false, nil
+	}
+	return revoked, err
+}
+
+// cleanup does nothing, redis removes the expired records.
+func (s *redisShareStore) cleanup() error {
+	return nil
+}
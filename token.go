@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrTokenPageUnprotected = errors.New("token endpoint and token relay require a page protected by an OIDC provider")
+	ErrTokenRelayProvider   = errors.New("token relay provider is not a provider of the page")
+)
+
+// key of the echo context for the access token, which the upstream handler sends to the backend
+const relayTokenKey = "relay_token"
+
+// tokenPage is a page with enabled token endpoint.
+type tokenPage struct {
+	protector echo.MiddlewareFunc
+	providers []string
+}
+
+// tokenResponse is the response of the token endpoint.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// unix timestamp, omitted when the IdP did not send the expiry
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+// createTokenHandler creates the token endpoint, which returns the access token of the provider session as JSON.
+// The page of the query parameter must enable the endpoint and its protection must grant access.
+// Only same-origin script requests are answered, so other sites can not read the token.
+func (w *Webserver) createTokenHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		providerId := c.Param("provider")
+		page, ok := w.tokenPages[c.QueryParam("page")]
+		if !ok {
+			return c.String(http.StatusNotFound, "token endpoint is not enabled for the page")
+		}
+		if !slices.Contains(page.providers, providerId) {
+			return c.String(http.StatusBadRequest, "unknown OIDC provider")
+		}
+		if !isSameOriginRequest(c.Request()) {
+			return c.String(http.StatusForbidden, "cross-origin token request")
+		}
+
+		return page.protector(func(c echo.Context) error {
+			accessToken, expiresAt, err := w.oidc.sessionAccessToken(c, providerId)
+			if err != nil {
+				log.WithField("providerId", providerId).WithError(err).Debug("No access token for the token endpoint")
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "login_required"})
+			}
+			c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+			c.Response().Header().Set("Pragma", "no-cache")
+			response := tokenResponse{
+				AccessToken: accessToken,
+				TokenType:   "Bearer",
+				ExpiresAt:   expiresAt,
+			}
+			if expiresAt > 0 {
+				response.ExpiresIn = max(expiresAt-time.Now().Unix(), 0)
+			}
+			return c.JSON(http.StatusOK, response)
+		})(c)
+	}
+}
+
+// createTokenRelay creates a proxy handler, which sends the requests with the access token of the session to the backend.
+// Only same-origin script requests are relayed, so other sites can not use the token.
+func (w *Webserver) createTokenRelay(baseUrl string, relay *StaticPageTokenRelay) (echo.HandlerFunc, error) {
+	upstream, err := newUpstreamHandler(baseUrl, &relay.StaticPageUpstream)
+	if err != nil {
+		return nil, err
+	}
+	return func(c echo.Context) error {
+		if !isSameOriginRequest(c.Request()) {
+			return c.String(http.StatusForbidden, "cross-origin token relay request")
+		}
+		accessToken, _, err := w.oidc.sessionAccessToken(c, relay.Provider)
+		if err != nil {
+			log.WithField("providerId", relay.Provider).WithError(err).Debug("No access token for the token relay")
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "login_required"})
+		}
+		c.Set(relayTokenKey, accessToken)
+		return upstream(c)
+	}, nil
+}
+
+// createPageTokens registers the token endpoint and the token relays of the page.
+// The page must be protected and the relays can only use the providers of the page.
+func (w *Webserver) createPageTokens(group *echo.Group, baseContentUrl string, config StaticPage, protector echo.MiddlewareFunc, policy *AccessPolicy) error {
+	if protector == nil {
+		return fmt.Errorf("%w: %s", ErrTokenPageUnprotected, config.Id)
+	}
+	// machine accounts have no access token
+	var providers []string
+	for _, providerId := range policy.Providers() {
+		if _, ok := w.oidc.providers[providerId]; ok {
+			providers = append(providers, providerId)
+		}
+	}
+	if len(providers) == 0 {
+		return fmt.Errorf("%w: %s", ErrTokenPageUnprotected, config.Id)
+	}
+
+	if config.Token.Endpoint {
+		w.tokenPages[config.Id] = tokenPage{protector: protector, providers: providers}
+	}
+
+	for i := range config.Token.Relay {
+		relay := &config.Token.Relay[i]
+		if relay.Provider == "" {
+			relay.Provider = providers[0]
+		}
+		if !slices.Contains(providers, relay.Provider) {
+			return fmt.Errorf("%w: %s", ErrTokenRelayProvider, relay.Provider)
+		}
+		path := strings.TrimRight(normalizeRulePath(relay.Path), "/")
+		handler, err := w.createTokenRelay(baseContentUrl+path, relay)
+		if err != nil {
+			return err
+		}
+		group.Any(path, handler)
+		group.Any(path+"/*", handler)
+		log.WithFields(log.Fields{
+			"id":       config.Id,
+			"path":     path,
+			"upstream": relay.Url,
+			"provider": relay.Provider,
+		}).Info("attaching token relay for static page")
+	}
+	return nil
+}
+
+// isSameOriginRequest checks that the request is a same-origin script request, which other sites can not send.
+// The X-Requested-With header is required, it forces a CORS preflight for cross-origin requests.
+// Requests are rejected, when the Sec-Fetch-Site or Origin header shows another origin.
+func isSameOriginRequest(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") == "" {
+		return false
+	}
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" {
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return false
+		}
+	}
+	return true
+}
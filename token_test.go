@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsSameOriginRequest(t *testing.T) {
+	tests := []struct {
+		headers  map[string]string
+		expected bool
+	}{
+		{map[string]string{"X-Requested-With": "XMLHttpRequest"}, true},
+		{map[string]string{"X-Requested-With": "fetch", "Sec-Fetch-Site": "same-origin", "Origin": "https://files.example.com"}, true},
+		{nil, false},
+		{map[string]string{"X-Requested-With": "fetch", "Sec-Fetch-Site": "same-site"}, false},
+		{map[string]string{"X-Requested-With": "fetch", "Sec-Fetch-Site": "none"}, false},
+		{map[string]string{"X-Requested-With": "fetch", "Origin": "https://evil.example.com"}, false},
+		{map[string]string{"X-Requested-With": "fetch", "Origin": "null"}, false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "https://files.example.com/auth/idp/token?page=spa", nil)
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		if result := isSameOriginRequest(req); result != test.expected {
+			t.Errorf("unexpected result for %v: got %v, want %v", test.headers, result, test.expected)
+		}
+	}
+}
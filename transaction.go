@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/gob"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// each transaction is stored in its own session, which is named by the state
+const authTransactionSessionPrefix = "oidc_auth_tx_"
+const authTransactionKey = "oidc_auth_transaction"
+
+// the states are random base64url strings, other values are never used as session name
+var authTransactionStatePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// AuthTransaction contains the data of one login between the redirect to the IdP and the callback.
+// Each transaction is stored in its own session with the state in the name, so multiple logins
+// (e.g. in multiple tabs) can run in parallel without overwriting each other.
+type AuthTransaction struct {
+	Provider  string `json:"provider"`
+	TargetURL string `json:"target_url"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func init() {
+	gob.Register(AuthTransaction{})
+}
+
+// expired reports if the transaction is older than the ttl.
+func (t AuthTransaction) expired(ttl time.Duration) bool {
+	return time.Unix(t.CreatedAt, 0).Add(ttl).Before(time.Now())
+}
+
+// saveAuthTransaction stores the transaction for the state in its own session, which expires with the ttl.
+// Parallel logins never read or write the session of another transaction.
+func saveAuthTransaction(c echo.Context, state string, transaction AuthTransaction, ttl time.Duration) error {
+	sess, err := session.Get(authTransactionSessionPrefix+state, c)
+	if err != nil {
+		return err
+	}
+	sess.Values[authTransactionKey] = transaction
+	sess.Options.MaxAge = int(ttl.Seconds())
+	return sess.Save(c.Request(), c.Response())
+}
+
+// consumeAuthTransaction deletes the session of the state and returns its transaction.
+// It returns false, when no transaction exists or the transaction is expired.
+func consumeAuthTransaction(c echo.Context, state string, ttl time.Duration) (AuthTransaction, bool, error) {
+	if !authTransactionStatePattern.MatchString(state) {
+		return AuthTransaction{}, false, nil
+	}
+	sess, err := session.Get(authTransactionSessionPrefix+state, c)
+	if err != nil || sess.IsNew {
+		// missing or invalid cookie, e.g. after the session was deleted
+		return AuthTransaction{}, false, nil
+	}
+	transaction, ok := sess.Values[authTransactionKey].(AuthTransaction)
+	sess.Options.MaxAge = -1
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return AuthTransaction{}, false, err
+	}
+	if !ok || transaction.expired(ttl) {
+		return AuthTransaction{}, false, nil
+	}
+	return transaction, true, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+func TestAuthTransactions(t *testing.T) {
+	store := sessions.NewFilesystemStore(t.TempDir(), []byte("secret"))
+	ttl := time.Minute
+
+	// run runs the handler with the cookies and returns the cookies of the response
+	run := func(cookies []*http.Cookie, handler echo.HandlerFunc) []*http.Cookie {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/auth/p1/callback", nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		if err := session.Middleware(store)(handler)(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Result().Cookies()
+	}
+	save := func(state string, transaction AuthTransaction) []*http.Cookie {
+		t.Helper()
+		return run(nil, func(c echo.Context) error {
+			return saveAuthTransaction(c, state, transaction, ttl)
+		})
+	}
+	consume := func(cookies []*http.Cookie, state string) (AuthTransaction, bool) {
+		t.Helper()
+		var transaction AuthTransaction
+		var ok bool
+		run(cookies, func(c echo.Context) error {
+			var err error
+			transaction, ok, err = consumeAuthTransaction(c, state, ttl)
+			return err
+		})
+		return transaction, ok
+	}
+
+	// two logins start at the same time, so neither request carries the cookie of the other
+	tab1 := save("state-1", AuthTransaction{Provider: "p1", CreatedAt: time.Now().Unix()})
+	tab2 := save("state-2", AuthTransaction{Provider: "p2", CreatedAt: time.Now().Unix()})
+	expired := save("state-3", AuthTransaction{Provider: "p3", CreatedAt: time.Now().Add(-2 * ttl).Unix()})
+	cookies := append(append(append([]*http.Cookie{}, tab1...), tab2...), expired...)
+
+	transaction, ok := consume(cookies, "state-2")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, transaction.Provider, "p2")
+	transaction, ok = consume(cookies, "state-1")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, transaction.Provider, "p1")
+
+	// consumed only once, also when the old cookie is replayed
+	_, ok = consume(cookies, "state-2")
+	assert.Equal(t, ok, false)
+	_, ok = consume(cookies, "state-3")
+	assert.Equal(t, ok, false)
+	_, ok = consume(cookies, "")
+	assert.Equal(t, ok, false)
+	_, ok = consume(cookies, "state;1")
+	assert.Equal(t, ok, false)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// context key of the identity headers for the backend
+type identityHeadersKey struct{}
+
+// identityHeader is a header, which is set to the value of a user claim for the backend.
+type identityHeader struct {
+	name  string
+	claim claimPath
+}
+
+// newUpstreamHandler creates a handler, which proxies the requests of the page to the backend.
+// Websocket upgrades are proxied, the session and login cookies are not sent to the backend.
+// The identity headers are removed from the incoming requests and only set for authenticated users.
+func newUpstreamHandler(baseUrl string, cfg *StaticPageUpstream) (echo.HandlerFunc, error) {
+	target, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	var headers []identityHeader
+	for name, path := range cfg.IdentityHeaders {
+		claim, err := parseClaimPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("identity header %s: %w", name, err)
+		}
+		headers = append(headers, identityHeader{name: http.CanonicalHeaderKey(name), claim: claim})
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = cfg.Timeout
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			if cfg.StripPath {
+				r.Out.URL.Path = strings.TrimPrefix(r.Out.URL.Path, baseUrl)
+				r.Out.URL.RawPath = strings.TrimPrefix(r.Out.URL.RawPath, baseUrl)
+			}
+			r.SetURL(target)
+			r.SetXForwarded()
+			removeSessionCookie(r.Out)
+			removeShareLinkParam(r.Out)
+
+			// never trust identity headers of the client
+			for _, name := range []string{
+				HeaderAuthRequestUser, HeaderAuthRequestPreferredUsername,
+				HeaderAuthRequestEmail, HeaderAuthRequestGroups,
+			} {
+				r.Out.Header.Del(name)
+			}
+			for _, header := range headers {
+				r.Out.Header.Del(header.name)
+			}
+			if identity, ok := r.In.Context().Value(identityHeadersKey{}).(http.Header); ok {
+				for name, values := range identity {
+					r.Out.Header[name] = values
+				}
+			}
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.WithField("upstream", cfg.Url).WithError(err).Warn("Upstream request failed")
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	return func(c echo.Context) error {
+		req := c.Request()
+		// the identity of the user is set after the rewrite removed the client headers
+		identity := http.Header{}
+		if accessToken, ok := c.Get(relayTokenKey).(string); ok {
+			identity.Set(echo.HeaderAuthorization, "Bearer "+accessToken)
+		}
+		if accessContext, ok := c.Get(accessContextKey).(*AccessContext); ok {
+			if cfg.PassIdentity {
+				setAuthRequestHeaders(identity, accessContext)
+			}
+			user := accessContext.User()
+			for _, header := range headers {
+				if value, ok := header.claim.lookup(user); ok {
+					identity.Set(header.name, identityValue(value))
+				}
+			}
+		}
+		if len(identity) > 0 {
+			req = req.WithContext(context.WithValue(req.Context(), identityHeadersKey{}, identity))
+		}
+		proxy.ServeHTTP(c.Response(), req)
+		return nil
+	}, nil
+}
+
+// identityValue converts a claim value into a header value, arrays are joined with commas.
+func identityValue(value any) string {
+	if list, ok := value.([]any); ok {
+		values := make([]string, 0, len(list))
+		for _, item := range list {
+			values = append(values, fmt.Sprint(item))
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// removeShareLinkParam removes the share link from the query, so the backend can not log or reuse it.
+func removeShareLinkParam(r *http.Request) {
+	query := r.URL.Query()
+	if !query.Has(shareLinkParam) {
+		return
+	}
+	query.Del(shareLinkParam)
+	r.URL.RawQuery = query.Encode()
+}
+
+// removeSessionCookie removes the session cookie and the cookies of the auth transactions from the request,
+// all other cookies are kept.
+func removeSessionCookie(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != sessionName && !strings.HasPrefix(cookie.Name, authTransactionSessionPrefix) {
+			r.AddCookie(cookie)
+		}
+	}
+}
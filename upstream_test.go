@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+func TestUpstream(t *testing.T) {
+	backend := http.NewServeMux()
+	backend.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"uri":    r.URL.RequestURI(),
+			"user":   r.Header.Get(HeaderAuthRequestUser),
+			"email":  r.Header.Get("X-Email"),
+			"groups": r.Header.Get("X-Groups"),
+			"cookie": r.Header.Get("Cookie"),
+			"proto":  r.Header.Get("X-Forwarded-Proto"),
+		})
+	})
+	backend.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	backend.Handle("/ws", websocket.Handler(func(ws *websocket.Conn) {
+		var message string
+		if err := websocket.Message.Receive(ws, &message); err == nil {
+			_ = websocket.Message.Send(ws, "echo: "+message)
+		}
+	}))
+	backendServer := httptest.NewServer(backend)
+	defer backendServer.Close()
+
+	handler, err := newUpstreamHandler("/tools/app", &StaticPageUpstream{
+		Url:          backendServer.URL,
+		StripPath:    true,
+		PassIdentity: true,
+		IdentityHeaders: map[string]string{
+			"X-Email":  "email",
+			"x-groups": "roles",
+		},
+		DialTimeout: time.Second,
+		Timeout:     50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	group := e.Group("/tools/app")
+	group.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().Header.Get("X-Test-Anonymous") == "" {
+				c.Set(accessContextKey, &AccessContext{
+					Subject:  "1",
+					UserInfo: map[string]any{"email": "alice@example.com", "roles": []any{"a", "b"}},
+				})
+			}
+			return next(c)
+		}
+	})
+	group.Any("", handler)
+	group.Any("/*", handler)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	get := func(path string, headers map[string]string) map[string]string {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(&http.Cookie{Name: sessionName, Value: "secret"})
+		req.AddCookie(&http.Cookie{Name: authTransactionSessionPrefix + "state", Value: "secret"})
+		req.AddCookie(&http.Cookie{Name: "app", Value: "1"})
+		req.Header.Set(HeaderAuthRequestUser, "spoofed")
+		req.Header.Set("X-Email", "spoofed@example.com")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body map[string]string
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	body := get("/tools/app/x?y=1", nil)
+	expected := map[string]string{
+		"uri":    "/x?y=1",
+		"user":   "1",
+		"email":  "alice@example.com",
+		"groups": "a,b",
+		"cookie": "app=1",
+		"proto":  "http",
+	}
+	for key, value := range expected {
+		if body[key] != value {
+			t.Errorf("unexpected %s: got %q, want %q", key, body[key], value)
+		}
+	}
+
+	// the share link is not passed to the backend
+	body = get("/tools/app/x?share=token&y=1", nil)
+	if body["uri"] != "/x?y=1" {
+		t.Errorf("unexpected uri with share link: %s", body["uri"])
+	}
+
+	// the identity headers of the client are removed for anonymous users
+	body = get("/tools/app", map[string]string{"X-Test-Anonymous": "1"})
+	if body["uri"] != "/" || body["user"] != "" || body["email"] != "" {
+		t.Errorf("unexpected request for anonymous user: %v", body)
+	}
+
+	// timeout of the backend
+	res, err := http.Get(server.URL + "/tools/app/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected status %d, got %d", http.StatusBadGateway, res.StatusCode)
+	}
+
+	// websocket upgrade
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/tools/app/ws"
+	ws, err := websocket.Dial(wsURL, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ws.Close() }()
+	if err := websocket.Message.Send(ws, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	var message string
+	if err := websocket.Message.Receive(ws, &message); err != nil {
+		t.Fatal(err)
+	}
+	if message != "echo: hello" {
+		t.Errorf("unexpected websocket message: %q", message)
+	}
+}